@@ -0,0 +1,58 @@
+// kitgen generates a typed TypeScript client from the schema exported by
+// Route.ExportSchema
+//
+//	kitgen -schema schema.json -out client.ts
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/emptyhua/keep-in-touch"
+)
+
+func main() {
+	schemaPath := flag.String("schema", "-", "schema json file exported by Route.ExportSchema, - for stdin")
+	outPath := flag.String("out", "-", "output typescript file, - for stdout")
+	flag.Parse()
+
+	if err := run(*schemaPath, *outPath); err != nil {
+		fmt.Fprintln(os.Stderr, "kitgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(schemaPath, outPath string) error {
+	var in io.Reader = os.Stdin
+	if schemaPath != "-" {
+		f, err := os.Open(schemaPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	schema := &kit.Schema{}
+	if err := json.NewDecoder(in).Decode(schema); err != nil {
+		return fmt.Errorf("decode schema: %v", err)
+	}
+
+	if outPath == "-" {
+		return kit.WriteTypeScript(os.Stdout, schema)
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+
+	if err := kit.WriteTypeScript(f, schema); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +19,7 @@ const (
 
 const (
 	KitConnWriteQueueSize = 128
+	KitConnExecQueueSize  = 64 // messages waiting for handlers, reading blocks when it is full
 )
 
 var (
@@ -31,21 +33,47 @@ var (
 )
 
 type HandshakeHead struct {
-	SessionId string `json:"sid"`
+	Token        string   `json:"token,omitempty"` // resume token of the previous connection
+	Version      int      `json:"ver"`             // newest protocol version of the client
+	Capabilities []string `json:"caps"`            // capabilities supported by the client
+	Key          string   `json:"key,omitempty"`   // public key of CapabilityEncryption
+}
+
+// HandshakeResponse is sent back for the handshake
+type HandshakeResponse struct {
+	Code         int      `json:"code"`
+	Error        string   `json:"error,omitempty"`
+	Heartbeat    int64    `json:"hb,omitempty"`
+	Token        string   `json:"token,omitempty"` // resume token, valid once and rotated by every handshake
+	Version      int      `json:"ver"`
+	MinVersion   int      `json:"min_ver,omitempty"` // set when the version is rejected
+	Capabilities []string `json:"caps"`
+	Key          string   `json:"key,omitempty"` // public key of CapabilityEncryption
+	Signature    string   `json:"sig,omitempty"` // of Key by Server.EncryptionKey
 }
 
 type KitConn struct {
 	Id             uint32
 	Server         *Server
-	Session        *Session
+	Session        *Session      // use getSession, it is cleared when closed
+	Identity       *PeerIdentity // verified client certificate, nil without mutual TLS
+	Protocol       WireProtocol  // negotiated by websocket subprotocol and handshake
+	Capabilities   []string      // negotiated in handshake
 	conn           net.Conn
-	status         int
-	mutex          sync.Mutex
+	status         int32      // atomic
+	mutex          sync.Mutex // guards Session
 	wg             sync.WaitGroup
 	decoder        *PacketDecoder
-	writeQueue     chan []byte
+	writeQueue     *writeQueue
+	writePolicy    SlowConsumerPolicy
+	writeBlock     time.Duration
+	writeTimeout   time.Duration
 	cancelRead     chan bool
+	execQueue      chan func() // handlers run in execWorker, off readWorker
 	heartbeatTimer *time.Ticker
+	cipher         *packetCipher // set when CapabilityEncryption is negotiated
+	cipherKey      string        // public key of server sent in handshake
+	cipherSig      string        // signature of cipherKey
 }
 
 func init() {
@@ -54,90 +82,146 @@ func init() {
 }
 
 func NewKitConn(server *Server, conn net.Conn) *KitConn {
-	kitConnId++
+	id := atomic.AddUint32(&kitConnId, 1)
+
+	queueSize := server.WriteQueueSize
+	if queueSize <= 0 {
+		queueSize = KitConnWriteQueueSize
+	}
 
 	kitConn := &KitConn{
-		Id:             kitConnId,
+		Id:             id,
 		Server:         server,
 		conn:           conn,
 		status:         KitConnStatusCreated,
+		Protocol:       defaultWireProtocol,
 		decoder:        NewPacketDecoder(),
-		writeQueue:     make(chan []byte, KitConnWriteQueueSize),
+		writeQueue:     newWriteQueue(queueSize),
+		writePolicy:    server.SlowConsumerPolicy,
+		writeBlock:     server.WriteBlockTimeout,
+		writeTimeout:   server.WriteTimeout,
 		cancelRead:     make(chan bool),
+		execQueue:      make(chan func(), KitConnExecQueueSize),
 		heartbeatTimer: time.NewTicker(server.HeartbeatInterval),
 	}
 	return kitConn
 }
 
 func (c *KitConn) String() string {
-	if c.conn != nil {
-		return fmt.Sprintf("KitConn(remote:%v id:%d)", c.conn.RemoteAddr(), c.Id)
-	} else {
+	if c.isClosed() {
 		return fmt.Sprintf("KitConn(closed id:%d)", c.Id)
 	}
+	return fmt.Sprintf("KitConn(remote:%v id:%d)", c.conn.RemoteAddr(), c.Id)
 }
 
-func (c *KitConn) Close(reason string) {
+func (c *KitConn) getStatus() int32 {
+	return atomic.LoadInt32(&c.status)
+}
+
+func (c *KitConn) isClosed() bool {
+	return c.getStatus() == KitConnStatusClosed
+}
+
+// advance moves status from one to another, false if the status is not from,
+// e.g. closed meanwhile
+func (c *KitConn) advance(from, to int32) bool {
+	return atomic.CompareAndSwapInt32(&c.status, from, to)
+}
+
+func (c *KitConn) getSession() *Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Session
+}
+
+// setSession fails if the conn is closed, Close would not see the session
+func (c *KitConn) setSession(session *Session) bool {
 	c.mutex.Lock()
-	if c.status == KitConnStatusClosed {
-		c.mutex.Unlock()
+	defer c.mutex.Unlock()
+	if c.isClosed() {
+		return false
+	}
+	c.Session = session
+	return true
+}
+
+func (c *KitConn) Close(reason string) {
+	if atomic.SwapInt32(&c.status, KitConnStatusClosed) == KitConnStatusClosed {
 		Logger.Warnf("%v.Close(%s) already closed return", c, reason)
 		return
 	}
-	c.status = KitConnStatusClosed
-	c.mutex.Unlock()
 
 	Logger.Debugf("%v.Close(%s)", c, reason)
 
-	c.Server = nil
+	// status is closed before detaching, see Session.setConn
+	c.mutex.Lock()
+	session := c.Session
+	c.Session = nil
+	c.mutex.Unlock()
 
-	if c.Session != nil && c.Session.getConn() == c {
-		c.Session.lostConn()
+	if session != nil {
+		session.lostConn(c)
 	}
-	c.Session = nil
 
 	close(c.cancelRead) // 取消读
 
-	if len(c.writeQueue) < KitConnWriteQueueSize {
-		c.writeQueue <- ConnClosePacket
-	}
+	c.writeQueue.closeWith(&outPacket{typ: PacketClose})
 }
 
 func (c *KitConn) WriteMsg(msg *Message) error {
-	if c.status != KitConnStatusWorking {
+	if c.getStatus() != KitConnStatusWorking {
 		return ErrInvalidConnStatus
 	}
 
-	if len(c.writeQueue) >= KitConnWriteQueueSize {
-		return ErrBufferExceed
-	}
-
 	payload, err := msg.Encode()
 	if err != nil {
 		panic(err)
 	}
 
-	packet := &Packet{Type: PacketData, Data: payload}
-	d, err := packet.Encode()
-	if err != nil {
-		panic(err)
+	p := &outPacket{typ: PacketData, data: payload, priority: msg.Priority}
+	if msg.CoalesceKey != "" {
+		p.key = msg.CoalesceKey
+	} else if msg.Type == MessagePush {
+		p.route = msg.Route
 	}
 
-	c.writeQueue <- d
-	return nil
+	err = c.writeQueue.push(p, c.writePolicy, c.writeBlock)
+	if err == ErrBufferExceed && c.writePolicy == SlowConsumerDisconnect {
+		c.Close("slow consumer")
+	}
+	return err
 }
 
 func (c *KitConn) Handle() {
+	var handshakeTimer *time.Timer
+	if timeout := c.Server.HandshakeTimeout; timeout > 0 {
+		handshakeTimer = time.AfterFunc(timeout, c.checkHandshake)
+	}
+
 	c.wg.Add(2)
 	go c.writeWorker()
+	go c.execWorker()
 	c.readWorker()
 	c.wg.Wait()
-	if c.status != KitConnStatusClosed {
+	if !c.isClosed() {
 		c.Close("read & write existed")
 	}
+	if handshakeTimer != nil {
+		handshakeTimer.Stop()
+	}
 	c.heartbeatTimer.Stop()
 	c.conn.Close()
-	c.conn = nil
+}
+
+// checkHandshake closes the connection if handshake is not finished
+func (c *KitConn) checkHandshake() {
+	if c.getStatus() >= KitConnStatusWorking {
+		return
+	}
+
+	c.Close("handshake timeout")
+	// unblock readWorker
+	c.conn.SetReadDeadline(time.Now())
 }
 
 func (c *KitConn) writeWorker() {
@@ -146,23 +230,70 @@ func (c *KitConn) writeWorker() {
 	for {
 		select {
 		case <-c.heartbeatTimer.C:
-			c.writeQueue <- HeartbeatPacket
-		case data := <-c.writeQueue:
-			if _, err := c.conn.Write(data); err != nil {
+			if err := c.write(HeartbeatPacket); err != nil {
 				Logger.Debugf("%v write error: %v", c, err)
+				c.stopReading("write error")
 				return
 			}
+		case <-c.writeQueue.ready:
+			for p := c.writeQueue.pop(); p != nil; p = c.writeQueue.pop() {
+				body := p.data
+				if p.typ == PacketData && c.cipher != nil {
+					// sealed here rather than in WriteMsg, nonces follow the wire order
+					body = c.cipher.seal(body)
+				}
+
+				data, err := (&Packet{Type: p.typ, Data: body}).Encode()
+				if err != nil {
+					panic(err)
+				}
+
+				if err := c.write(data); err != nil {
+					Logger.Debugf("%v write error: %v", c, err)
+					c.stopReading("write error")
+					return
+				}
+			}
 
 			// connection closed and all buf writed
-			if c.status == KitConnStatusClosed && len(c.writeQueue) == 0 {
+			if c.isClosed() && c.writeQueue.len() == 0 {
+				c.stopReading("closed")
 				return
 			}
 		}
 	}
 }
 
+// stopReading closes the connection and unblocks readWorker after writing ended,
+// readWorker would wait for the peer to go away, transports like long poll are
+// never closed by the peer
+func (c *KitConn) stopReading(reason string) {
+	if !c.isClosed() {
+		c.Close(reason)
+	}
+	c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *KitConn) write(data []byte) error {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// execWorker runs handlers one by one, it is not waited by Handle as a handler
+// could be waiting for a response of the closed connection. Handlers queued
+// before closing still run, their responses are kept by the session.
+func (c *KitConn) execWorker() {
+	for fn := range c.execQueue {
+		fn()
+	}
+}
+
 func (c *KitConn) readWorker() {
 	defer c.wg.Done()
+	defer close(c.execQueue)
 
 	buf := make([]byte, 2048)
 	for {
@@ -175,12 +306,17 @@ func (c *KitConn) readWorker() {
 		n, err := c.conn.Read(buf)
 		if err != nil {
 			Logger.Debugf("%v read error: %v", c, err)
+			// peer is gone, do not wait for the heartbeat write to fail
+			if !c.isClosed() {
+				c.Close("read error")
+			}
 			return
 		}
 
 		packets, err := c.decoder.Decode(buf[:n])
 		if err != nil {
 			Logger.Errorf("%v decode.Decode error: %v", c, err)
+			c.Close("decode error")
 			return
 		}
 
@@ -192,79 +328,228 @@ func (c *KitConn) readWorker() {
 		for _, p := range packets {
 			if err := c.processPacket(p); err != nil {
 				Logger.Errorf("%v processPacket error %v", c, err)
+				c.Close("process packet error")
 				return
 			}
 		}
 	}
 }
 
+// HasCapability reports whether the capability is negotiated
+func (c *KitConn) HasCapability(name string) bool {
+	for _, capability := range c.Capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *KitConn) handshakeData(token string) []byte {
+	caps := c.Capabilities
+	if caps == nil {
+		caps = []string{}
+	}
+	data, _ := json.Marshal(&HandshakeResponse{
+		Code:         CodeOK,
+		Heartbeat:    int64(c.Server.HeartbeatInterval / time.Second),
+		Token:        token,
+		Version:      c.Protocol.Version,
+		Capabilities: caps,
+		Key:          c.cipherKey,
+		Signature:    c.cipherSig,
+	})
+	return data
+}
+
+func (c *KitConn) rejectHandshake(resp *HandshakeResponse, reason string) {
+	resp.Version = c.Protocol.Version
+	resp.Capabilities = []string{}
+	data, _ := json.Marshal(resp)
+	c.writeQueue.pushControl(&outPacket{typ: PacketHandshake, data: data})
+	c.Close(reason)
+}
+
+// negotiate settles protocol version and capabilities of the handshake, the
+// connection is rejected and closed if the client is too old
+func (c *KitConn) negotiate(handInfo *HandshakeHead) bool {
+	min := c.Server.MinProtocolVersion
+	if min <= 0 {
+		min = 1
+	}
+
+	version, ok := negotiateVersion(handInfo.Version, min, c.Protocol.Version)
+	if !ok {
+		c.rejectHandshake(&HandshakeResponse{
+			Code:       CodeVersionNotSupported,
+			Error:      fmt.Sprintf("protocol version %d not supported", handInfo.Version),
+			MinVersion: min,
+		}, "protocol version not supported")
+		return false
+	}
+
+	c.Protocol.Version = version
+	caps := negotiateCapabilities(c.Server.Capabilities, handInfo.Capabilities)
+	c.Capabilities = caps
+
+	if !c.HasCapability(CapabilityEncryption) {
+		if c.Server.RequireEncryption {
+			c.rejectHandshake(&HandshakeResponse{
+				Code:  CodeEncryptionRequired,
+				Error: "encryption required",
+			}, "encryption required")
+			return false
+		}
+		return true
+	}
+
+	// text frames carry json, only binary codec could be encrypted, never
+	// fall back to plain text once both sides asked for encryption
+	if c.Protocol.Codec != CodecBinary {
+		c.rejectHandshake(&HandshakeResponse{
+			Code:  CodeBadRequest,
+			Error: "encryption requires codec " + CodecBinary,
+		}, "encryption with text codec")
+		return false
+	}
+
+	cipher, key, sig, err := newPacketCipher(handInfo.Key, c.Server.EncryptionKey)
+	if err != nil {
+		if err == ErrEncryptionKeyMissing {
+			Logger.Errorf("%v %v", c, err)
+		}
+		c.rejectHandshake(&HandshakeResponse{
+			Code:  CodeBadRequest,
+			Error: err.Error(),
+		}, "encryption key exchange failed")
+		return false
+	}
+	c.cipher = cipher
+	c.cipherKey = key
+	c.cipherSig = sig
+	return true
+}
+
+// attachSession skips the handshake for transports which can not send packets
+func (c *KitConn) attachSession(session *Session, token string) {
+	if !c.setSession(session) {
+		session.lostConn(c)
+		return
+	}
+	c.writeQueue.pushControl(&outPacket{typ: PacketHandshake, data: c.handshakeData(token)})
+	if c.advance(KitConnStatusCreated, KitConnStatusWorking) {
+		session.setConn(c)
+	}
+}
+
 func (c *KitConn) processPacket(p *Packet) error {
-	if c.status == KitConnStatusClosed {
+	if c.isClosed() {
 		return nil
 	}
 	switch p.Type {
 	case PacketHandshake:
 		{
-			if c.status != KitConnStatusCreated {
+			if c.getStatus() != KitConnStatusCreated {
 				return fmt.Errorf("%v unexpected handshake from client", c)
 			}
 
 			var session *Session = nil
 
+			handInfo := HandshakeHead{}
 			if len(p.Data) > 0 {
-				handInfo := HandshakeHead{}
 				if err := json.Unmarshal(p.Data, &handInfo); err != nil {
 					return fmt.Errorf("%v invalid handshake data %s", c, string(p.Data))
 				}
+			}
 
-				if len(handInfo.SessionId) > 0 {
-					session = c.Server.SessionManager.GetSessionById(handInfo.SessionId)
-				}
+			if !c.negotiate(&handInfo) {
+				// closed by negotiate
+				Logger.Warnf("%v handshake rejected %s", c, string(p.Data))
+				return nil
+			}
+
+			var token string
+			if len(handInfo.Token) > 0 {
+				session, token = c.Server.resumeSession(handInfo.Token, c.Identity)
 			}
 
 			if session == nil {
 				session = c.Server.SessionManager.createSession()
-				Logger.Debugf("%v create new session %s", c, session.Id)
+				token = c.Server.issueResumeToken(session)
+				Logger.Debugf("%v create new session %v", c, session)
 			} else {
-				Logger.Debugf("%v find old session %s", c, session.Id)
+				Logger.Debugf("%v find old session %v", c, session)
+			}
+			if !c.setSession(session) {
+				// closed meanwhile, a new session must expire like a lost one
+				session.lostConn(c)
+				return nil
 			}
-			c.Session = session
-
-			data, _ := json.Marshal(map[string]interface{}{
-				"code": 200,
-				"hb":   c.Server.HeartbeatInterval / time.Second,
-				"sid":  session.Id,
-			})
-
-			handshakePacket, _ := (&Packet{Type: PacketHandshake, Data: data}).Encode()
 
-			c.writeQueue <- handshakePacket
-			c.status = KitConnStatusHandshake
-			Logger.Debugf("%v send handshake to client", c)
+			c.writeQueue.pushControl(&outPacket{typ: PacketHandshake, data: c.handshakeData(token)})
+			if !c.advance(KitConnStatusCreated, KitConnStatusHandshake) {
+				// closed meanwhile, Close passed the session to lostConn
+				return nil
+			}
+			Logger.Debugf("%v send handshake to client, protocol %v capabilities %v", c, c.Protocol, c.Capabilities)
 		}
 	case PacketHandshakeAck:
-		c.status = KitConnStatusWorking
+		if !c.advance(KitConnStatusHandshake, KitConnStatusWorking) {
+			return fmt.Errorf("%v unexpected handshake ack from client", c)
+		}
 		Logger.Debugf("%v receiv handshake ack", c)
-		if c.Session != nil {
-			c.Session.setConn(c)
+		if session := c.getSession(); session != nil {
+			session.setConn(c)
 		}
 	case PacketData:
-		if c.status < KitConnStatusWorking {
+		if c.getStatus() < KitConnStatusWorking {
 			return fmt.Errorf("%v receiv data before handshake ack", c)
 		}
 
-		msg, err := DecodeMessageFromRaw(p.Data)
+		raw := p.Data
+		if c.cipher != nil {
+			var err error
+			if raw, err = c.cipher.open(raw); err != nil {
+				return err
+			}
+		}
+
+		msg, err := DecodeMessageFromRaw(raw)
 		if err != nil {
 			return err
 		}
 
 		Logger.Debugf("%v got msg %v", c, msg)
-		c.Server.Route.Exec(c.Session, msg)
+		session := c.getSession()
+		if session == nil {
+			// replaced by another connection
+			return nil
+		}
+
+		// ids from httpReqIdBase are allocated by the server, see captureResponse
+		if msg.Type == MessageRequest && msg.ID >= httpReqIdBase {
+			return fmt.Errorf("%v request id %d out of range", c, msg.ID)
+		}
+
+		if msg.Type == MessageResponse {
+			session.onResponse(msg)
+			return nil
+		}
+
+		if !c.Server.checkRateLimit(session, msg) {
+			if c.isClosed() {
+				return fmt.Errorf("%v kicked for exceeding rate limit", c)
+			}
+			return nil
+		}
+		// readWorker must not wait for the handler, it delivers responses to
+		// Session.Request called by the handler
+		c.execQueue <- func() { c.Server.Route.Exec(session, msg) }
 	case PacketClose:
 		// 客户端主动关闭Session
 		Logger.Debugf("%v receiv session close packet", c)
-		if c.Session != nil {
-			c.Session.Close("closed by client")
+		if session := c.getSession(); session != nil {
+			session.Close("closed by client")
 		}
 	case PacketHeartbeat:
 	default:
@@ -0,0 +1,288 @@
+package kit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type Asker struct {
+	synced chan bool
+}
+
+type SyncNotify struct{}
+
+type AskReq struct {
+	RequestHead
+}
+
+type AskResp struct {
+	Answer int    `json:"answer"`
+	Code   int    `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Ask asks the client in the handler and responds with its answer
+func (h *Asker) Ask(s *Session, r *AskReq) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp := AskResp{}
+	err := s.Request(ctx, "client.answer", struct{}{}, &resp)
+	reqErr := &RequestError{}
+	if errors.As(err, &reqErr) {
+		resp = AskResp{Code: reqErr.Code, Error: reqErr.Message}
+	} else if err != nil {
+		resp = AskResp{Error: err.Error()}
+	}
+	s.Response(r, resp)
+}
+
+// Sync is handled after all handlers before it returned
+func (h *Asker) Sync(s *Session, r *SyncNotify) {
+	h.synced <- true
+}
+
+func TestRequestFromHandler(t *testing.T) {
+	route := NewRoute()
+	h := &Asker{synced: make(chan bool)}
+	route.Reg("test", h)
+	server := NewServer(route)
+	c := dialTest(t, server, nil, true)
+	defer c.conn.Close()
+
+	cases := []struct {
+		reply interface{}
+		want  AskResp
+	}{
+		{map[string]int{"answer": 42}, AskResp{Answer: 42}},
+		{&ErrorResponse{Code: CodeNotFound, Error: "no answer"}, AskResp{Code: CodeNotFound, Error: "no answer"}},
+	}
+
+	for i, tc := range cases {
+		id := uint(i + 1)
+		c.sendMsg(MessageRequest, id, "test.ask", struct{}{})
+
+		req := c.readMsg()
+		if req.Type != MessageRequest || req.Route != "client.answer" {
+			t.Fatalf("expected a request from the server, got %+v", req)
+		}
+		c.sendMsg(MessageResponse, req.ID, "", tc.reply)
+
+		resp := c.readMsg()
+		if resp.Type != MessageResponse || resp.ID != id {
+			t.Fatalf("expected the response of %d, got %+v", id, resp)
+		}
+		got := AskResp{}
+		if err := json.Unmarshal(resp.Data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Fatalf("got %+v, want %+v", got, tc.want)
+		}
+	}
+
+	// wait for the handlers before the test returns
+	c.sendMsg(MessageNotify, 0, "test.sync", struct{}{})
+	<-h.synced
+}
+
+type Later struct {
+	done chan *Session
+}
+
+// Reply responds after the handler returned
+func (h *Later) Reply(s *Session, r *AskReq) {
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Response(r, AskResp{Answer: 1})
+		h.done <- s
+	}()
+}
+
+// Never never responds
+func (h *Later) Never(s *Session, r *AskReq) {
+	h.done <- s
+}
+
+func TestNoResponseTimeoutDisabled(t *testing.T) {
+	h := &Later{done: make(chan *Session, 1)}
+	asker := &Asker{synced: make(chan bool)}
+	route := NewRoute()
+	route.NoResponseTimeout = 0
+	route.Reg("test", h)
+	route.Reg("asker", asker)
+	server := NewServer(route)
+	c := dialTest(t, server, nil, true)
+	defer c.conn.Close()
+
+	c.sendMsg(MessageRequest, 1, "test.reply", struct{}{})
+	if msg := c.readMsg(); msg.ID != 1 || string(msg.Data) != `{"answer":1}` {
+		t.Fatalf("unexpected response %+v", msg)
+	}
+	<-h.done
+
+	c.sendMsg(MessageRequest, 2, "test.never", struct{}{})
+	s := <-h.done
+	c.sendMsg(MessageNotify, 0, "asker.sync", struct{}{})
+	<-asker.synced
+
+	s.reqMutex.Lock()
+	n := len(s.inflight)
+	s.reqMutex.Unlock()
+	if n != 1 {
+		t.Fatalf("%d requests inflight, want the unanswered one", n)
+	}
+
+	s.Close("test")
+	s.reqMutex.Lock()
+	defer s.reqMutex.Unlock()
+	if len(s.inflight) != 0 {
+		t.Fatalf("%d requests left inflight", len(s.inflight))
+	}
+}
+
+type Bye struct{}
+
+// Bye pushes a notice and closes the session
+func (h *Bye) Bye(s *Session, r *SyncNotify) {
+	for i := 0; i < 10; i++ {
+		s.PushWithPriority(PriorityHigh, "notice", i)
+	}
+	s.Close("bye")
+}
+
+func TestCloseAfterHighPriorityMessages(t *testing.T) {
+	route := NewRoute()
+	route.Reg("test", &Bye{})
+	server := NewServer(route)
+	c := dialTest(t, server, nil, true)
+	defer c.conn.Close()
+
+	c.sendMsg(MessageNotify, 0, "test.bye", struct{}{})
+	pushes := 0
+	for p := c.next(); p.Type != PacketClose; p = c.next() {
+		if p.Type == PacketData {
+			pushes++
+		}
+	}
+	if pushes != 10 {
+		t.Fatalf("got %d of 10 pushes before close", pushes)
+	}
+}
+
+func TestSessionExpiresWithoutAck(t *testing.T) {
+	server := NewServer(NewRoute())
+	c := dialTest(t, server, nil, false)
+	if server.SessionManager.Count() != 1 {
+		t.Fatal("no session created at handshake")
+	}
+	c.conn.Close()
+
+	// what CheckExpire does after SessionExpireTimeout
+	manager := server.SessionManager
+	waitUntil(t, func() bool { return manager.expiry.len() == 1 })
+	now := time.Now().Add(SessionExpireTimeout + time.Second)
+	expired, _ := manager.expiry.popExpired(now)
+	for _, session := range expired {
+		session.closeExpired(now)
+	}
+	if n := manager.Count(); n != 0 {
+		t.Fatalf("%d sessions left after expired", n)
+	}
+}
+
+// newBlockedSession returns a connected session whose writer is stuck writing
+// the push "block" until the client reads, later writes stay in the queue
+func newBlockedSession(t *testing.T) (*testClient, *Session) {
+	server := NewServer(NewRoute())
+	attached := make(chan *Session, 1)
+	server.AddHooks(&SessionHooks{
+		OnConnAttached: func(s *Session, c *KitConn) {
+			attached <- s
+		},
+	})
+	c := dialTest(t, server, nil, true)
+	s := <-attached
+
+	s.Push("block", nil)
+	waitUntil(t, func() bool { return s.getConn().writeQueue.len() == 0 })
+	return c, s
+}
+
+// resumeOffline resumes s, which never had a connection, and returns the client
+func resumeOffline(t *testing.T, server *Server, s *Session) *testClient {
+	return dialTest(t, server, &HandshakeHead{Token: server.issueResumeToken(s)}, true)
+}
+
+// expectRoutes reads pushes and compares their routes and data
+func (c *testClient) expectRoutes(want ...string) {
+	c.t.Helper()
+	for _, w := range want {
+		msg := c.readMsg()
+		if got := msg.Route + string(msg.Data); got != w {
+			c.t.Fatalf("got %s, want %s", got, w)
+		}
+	}
+}
+
+func TestPushCoalescedQueued(t *testing.T) {
+	c, s := newBlockedSession(t)
+	defer c.conn.Close()
+
+	s.PushCoalesced("pos", "a", 1)
+	s.PushCoalesced("pos", "b", 1)
+	s.Push("chat", 1)
+	s.PushCoalesced("pos", "a", 2)
+	if n := s.getConn().writeQueue.len(); n != 3 {
+		t.Fatalf("%d queued, want 3", n)
+	}
+	c.expectRoutes("blocknull", "pos2", "pos1", "chat1")
+}
+
+func TestPushCoalescedDelayed(t *testing.T) {
+	server := NewServer(NewRoute())
+	s := server.SessionManager.createSession()
+
+	s.PushCoalesced("pos", "a", 1)
+	s.Push("chat", 1)
+	s.PushCoalesced("pos", "a", 2)
+	s.PushCoalesced("pos", "b", 3)
+	s.RLock()
+	n := len(s.delayMsgs)
+	s.RUnlock()
+	if n != 3 {
+		t.Fatalf("%d delayed, want 3", n)
+	}
+
+	c := resumeOffline(t, server, s)
+	defer c.conn.Close()
+	c.expectRoutes("pos2", "chat1", "pos3")
+}
+
+func TestHighPriorityQueued(t *testing.T) {
+	c, s := newBlockedSession(t)
+	defer c.conn.Close()
+
+	s.Push("chat", 1)
+	s.Push("chat", 2)
+	s.PushWithPriority(PriorityHigh, "kick", 1)
+	s.PushWithPriority(PriorityHigh, "kick", 2)
+	c.expectRoutes("blocknull", "kick1", "kick2", "chat1", "chat2")
+}
+
+func TestHighPriorityDelayed(t *testing.T) {
+	server := NewServer(NewRoute())
+	s := server.SessionManager.createSession()
+
+	s.Push("chat", 1)
+	s.PushWithPriority(PriorityHigh, "kick", 1)
+	s.Push("chat", 2)
+	s.PushWithPriority(PriorityHigh, "kick", 2)
+
+	c := resumeOffline(t, server, s)
+	defer c.conn.Close()
+	c.expectRoutes("kick1", "kick2", "chat1", "chat2")
+}
@@ -0,0 +1,197 @@
+package kit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// CapabilityEncryption encrypts PacketData bodies of the connection, keys are
+// agreed by ECDH on P-256 in the handshake and packets are sealed with AES-GCM.
+// The client sends its uncompressed public key as base64 in "key" of the
+// handshake and the server replies its own in "key", with "sig", the ECDSA
+// P-256 SHA-256 signature by Server.EncryptionKey of
+// "kit e2e v1" || client key || server key as base64 of r || s. Clients pin
+// the public key of Server.EncryptionKey and verify "sig", so a proxy in the
+// middle can not replace the keys.
+const CapabilityEncryption = "e2e.p256.aesgcm"
+
+var (
+	ErrInvalidPublicKey     = errors.New("kit:invalid encryption public key")
+	ErrDecryptPacket        = errors.New("kit:decrypt packet failed")
+	ErrEncryptionKeyMissing = errors.New("kit:encryption offered without Server.EncryptionKey")
+)
+
+var encryptionSignContext = []byte("kit e2e v1")
+
+// hkdf info of each direction
+var (
+	hkdfInfoClientToServer = []byte("kit e2e client to server")
+	hkdfInfoServerToClient = []byte("kit e2e server to client")
+)
+
+// packetCipher seals outgoing and opens incoming packet bodies of a connection,
+// nonces are the packet counters of each direction so packets must be sealed
+// and opened in wire order
+type packetCipher struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// GenerateEncryptionKey returns a new key for Server.EncryptionKey
+func GenerateEncryptionKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// EncryptionPublicKey returns the public key of Server.EncryptionKey clients
+// should pin, base64 of the uncompressed point, which WebCrypto imports as "raw"
+func EncryptionPublicKey(key *ecdsa.PrivateKey) (string, error) {
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub.Bytes()), nil
+}
+
+// ParseEncryptionKey parses a PKCS#8 or SEC 1 DER private key for Server.EncryptionKey
+func ParseEncryptionKey(der []byte) (*ecdsa.PrivateKey, error) {
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, errors.New("kit:encryption key must be ECDSA P-256")
+	}
+	return ecKey, nil
+}
+
+// newPacketCipher does the server side key exchange with the base64 public key
+// of client, the server public key and its signature by signer are returned in
+// base64
+func newPacketCipher(clientKey string, signer *ecdsa.PrivateKey) (*packetCipher, string, string, error) {
+	if signer == nil {
+		return nil, "", "", ErrEncryptionKeyMissing
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(clientKey)
+	if err != nil {
+		return nil, "", "", ErrInvalidPublicKey
+	}
+	clientPub, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, "", "", ErrInvalidPublicKey
+	}
+
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", "", err
+	}
+	secret, err := priv.ECDH(clientPub)
+	if err != nil {
+		return nil, "", "", ErrInvalidPublicKey
+	}
+
+	serverKey := priv.PublicKey().Bytes()
+	sig, err := signEncryptionKeys(signer, raw, serverKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// both public keys salt the derivation, so keys differ even if a side reuses its key pair
+	salt := append(append([]byte{}, raw...), serverKey...)
+
+	send, err := newGCM(hkdfSHA256(secret, salt, hkdfInfoServerToClient, 32))
+	if err != nil {
+		return nil, "", "", err
+	}
+	recv, err := newGCM(hkdfSHA256(secret, salt, hkdfInfoClientToServer, 32))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return &packetCipher{send: send, recv: recv},
+		base64.StdEncoding.EncodeToString(serverKey),
+		base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// signEncryptionKeys returns r || s, the signature format of WebCrypto
+func signEncryptionKeys(signer *ecdsa.PrivateKey, clientKey, serverKey []byte) ([]byte, error) {
+	h := sha256.New()
+	h.Write(encryptionSignContext)
+	h.Write(clientKey)
+	h.Write(serverKey)
+
+	r, s, err := ecdsa.Sign(rand.Reader, signer, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdfSHA256 is HKDF of RFC 5869, n must not exceed 255*32
+func hkdfSHA256(secret, salt, info []byte, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, t []byte
+	for i := byte(1); len(out) < n; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+func packetNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// seal is only called by writeWorker
+func (c *packetCipher) seal(data []byte) []byte {
+	nonce := packetNonce(c.sendSeq)
+	c.sendSeq++
+	return c.send.Seal(nil, nonce, data, nil)
+}
+
+// open is only called by readWorker
+func (c *packetCipher) open(data []byte) ([]byte, error) {
+	nonce := packetNonce(c.recvSeq)
+	c.recvSeq++
+	plain, err := c.recv.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, ErrDecryptPacket
+	}
+	return plain, nil
+}
@@ -0,0 +1,155 @@
+package kit
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"testing"
+)
+
+type Echo struct{}
+
+type EchoReq struct {
+	RequestHead
+	Text string `json:"text"`
+}
+
+func (h *Echo) Say(s *Session, r *EchoReq) {
+	s.Response(r, r)
+}
+
+func newEncryptedServer(t *testing.T) *Server {
+	key, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := NewRoute()
+	route.Reg("echo", &Echo{})
+	server := NewServer(route)
+	server.Capabilities = []string{CapabilityEncryption}
+	server.EncryptionKey = key
+	return server
+}
+
+func newClientKey(t *testing.T) (*ecdh.PrivateKey, string) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())
+}
+
+// clientCipher verifies the handshake like a client pinning pinned and returns
+// the cipher of the client side
+func clientCipher(t *testing.T, pinned *ecdsa.PublicKey, priv *ecdh.PrivateKey, resp *HandshakeResponse) *packetCipher {
+	serverKey, _ := base64.StdEncoding.DecodeString(resp.Key)
+	sig, _ := base64.StdEncoding.DecodeString(resp.Signature)
+	if len(sig) != 64 {
+		t.Fatalf("signature of %d bytes", len(sig))
+	}
+
+	clientKey := priv.PublicKey().Bytes()
+	h := sha256.New()
+	h.Write(encryptionSignContext)
+	h.Write(clientKey)
+	h.Write(serverKey)
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pinned, h.Sum(nil), r, s) {
+		t.Fatal("server key signature not verified")
+	}
+
+	pub, err := ecdh.P256().NewPublicKey(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := append(append([]byte{}, clientKey...), serverKey...)
+	send, _ := newGCM(hkdfSHA256(secret, salt, hkdfInfoClientToServer, 32))
+	recv, _ := newGCM(hkdfSHA256(secret, salt, hkdfInfoServerToClient, 32))
+	return &packetCipher{send: send, recv: recv}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	server := newEncryptedServer(t)
+	priv, key := newClientKey(t)
+
+	c := newTestClient(t, server)
+	defer c.conn.Close()
+	resp := c.handshake(&HandshakeHead{Capabilities: []string{CapabilityEncryption}, Key: key})
+	if resp.Code != CodeOK || len(resp.Capabilities) != 1 {
+		t.Fatalf("handshake %+v", resp)
+	}
+	cipher := clientCipher(t, &server.EncryptionKey.PublicKey, priv, resp)
+	c.send(PacketHandshakeAck, nil)
+
+	data, _ := NewMessage(MessageRequest, 1, "echo.say", &EchoReq{Text: "hi"}).Encode()
+	c.send(PacketData, cipher.seal(data))
+
+	plain, err := cipher.open(c.read(PacketData).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := DecodeMessageFromRaw(plain)
+	if string(msg.Data) != `{"text":"hi"}` {
+		t.Fatalf("unexpected response %s", msg.Data)
+	}
+}
+
+func TestEncryptionSignedByPinnedKey(t *testing.T) {
+	server := newEncryptedServer(t)
+	priv, key := newClientKey(t)
+
+	c := newTestClient(t, server)
+	defer c.conn.Close()
+	resp := c.handshake(&HandshakeHead{Capabilities: []string{CapabilityEncryption}, Key: key})
+
+	// a key replaced in the middle does not verify
+	_, resp.Key = newClientKey(t)
+	serverKey, _ := base64.StdEncoding.DecodeString(resp.Key)
+	sig, _ := base64.StdEncoding.DecodeString(resp.Signature)
+	h := sha256.New()
+	h.Write(encryptionSignContext)
+	h.Write(priv.PublicKey().Bytes())
+	h.Write(serverKey)
+	if ecdsa.Verify(&server.EncryptionKey.PublicKey, h.Sum(nil), new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatal("signature verified a replaced key")
+	}
+}
+
+func TestEncryptionNeverDowngraded(t *testing.T) {
+	_, key := newClientKey(t)
+	head := &HandshakeHead{Version: ProtocolVersion, Capabilities: []string{CapabilityEncryption}, Key: key}
+
+	cases := map[string]func(*Server, *KitConn){
+		"json codec":  func(s *Server, c *KitConn) { c.Protocol.Codec = CodecJSON },
+		"no sign key": func(s *Server, c *KitConn) { s.EncryptionKey = nil },
+	}
+	for name, setup := range cases {
+		server := newEncryptedServer(t)
+		client, conn := net.Pipe()
+		c := NewKitConn(server, conn)
+		setup(server, c)
+		if c.negotiate(head) {
+			t.Fatalf("%s: handshake accepted", name)
+		}
+		client.Close()
+	}
+}
+
+func TestRequireEncryption(t *testing.T) {
+	server := newEncryptedServer(t)
+	server.RequireEncryption = true
+
+	c := newTestClient(t, server)
+	defer c.conn.Close()
+	if resp := c.handshake(nil); resp.Code != CodeEncryptionRequired {
+		t.Fatalf("handshake without encryption returned %d", resp.Code)
+	}
+}
@@ -1,11 +1,16 @@
 module github.com/emptyhua/keep-in-touch
 
-go 1.15
+go 1.20
 
 require (
 	github.com/emptyhua/go-logging v0.0.0-20180827081610-e0b18c5d1d15
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/websocket v1.4.2
-	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	go.uber.org/zap v1.16.0
 )
+
+require (
+	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+)
@@ -0,0 +1,78 @@
+package kit
+
+// SessionHooks are server level callbacks of session lifecycle, nil funcs are
+// skipped. They are called synchronously from connection goroutines, so keep
+// them short and never block.
+type SessionHooks struct {
+	// a new session is created by handshake
+	OnSessionCreated func(s *Session)
+	// a connection is attached to the session, called for every connection
+	OnConnAttached func(s *Session, c *KitConn)
+	// the connection is lost, the session waits SessionExpireTimeout for resuming
+	OnConnLost func(s *Session)
+	// a new connection takes over the session after OnConnAttached, the previous
+	// one is lost, replaced or the session is restored from SessionStore
+	OnSessionResumed func(s *Session, c *KitConn)
+	// the session is closed, values of the session are still readable
+	OnSessionClosed func(s *Session, reason string)
+}
+
+// AddHooks registers session lifecycle callbacks, call it before serving
+func (s *Server) AddHooks(hooks *SessionHooks) {
+	s.SessionManager.AddHooks(hooks)
+}
+
+func (m *SessionManager) AddHooks(hooks *SessionHooks) {
+	m.Lock()
+	defer m.Unlock()
+	// copy on write, so firing needs no lock
+	m.hooks = append(m.hooks[:len(m.hooks):len(m.hooks)], hooks)
+}
+
+func (m *SessionManager) getHooks() []*SessionHooks {
+	m.RLock()
+	defer m.RUnlock()
+	return m.hooks
+}
+
+func (m *SessionManager) fireSessionCreated(s *Session) {
+	for _, h := range m.getHooks() {
+		if h.OnSessionCreated != nil {
+			h.OnSessionCreated(s)
+		}
+	}
+}
+
+func (m *SessionManager) fireConnAttached(s *Session, c *KitConn, resumed bool) {
+	hooks := m.getHooks()
+	for _, h := range hooks {
+		if h.OnConnAttached != nil {
+			h.OnConnAttached(s, c)
+		}
+	}
+
+	if !resumed {
+		return
+	}
+	for _, h := range hooks {
+		if h.OnSessionResumed != nil {
+			h.OnSessionResumed(s, c)
+		}
+	}
+}
+
+func (m *SessionManager) fireConnLost(s *Session) {
+	for _, h := range m.getHooks() {
+		if h.OnConnLost != nil {
+			h.OnConnLost(s)
+		}
+	}
+}
+
+func (m *SessionManager) fireSessionClosed(s *Session, reason string) {
+	for _, h := range m.getHooks() {
+		if h.OnSessionClosed != nil {
+			h.OnSessionClosed(s, reason)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package kit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHookOrder(t *testing.T) {
+	server := NewServer(NewRoute())
+	events := make(chan string, 16)
+	created := make(chan *Session, 1)
+	server.AddHooks(&SessionHooks{
+		OnSessionCreated: func(s *Session) {
+			events <- "created"
+			created <- s
+		},
+		OnConnAttached: func(s *Session, c *KitConn) {
+			events <- "attached"
+		},
+		OnConnLost: func(s *Session) {
+			events <- "lost"
+		},
+		OnSessionResumed: func(s *Session, c *KitConn) {
+			events <- "resumed"
+		},
+		OnSessionClosed: func(s *Session, reason string) {
+			events <- fmt.Sprintf("closed %s %v", reason, s.Value("user"))
+		},
+	})
+
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case got := <-events:
+				if got != w {
+					t.Fatalf("got %s, want %s", got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s", w)
+			}
+		}
+		select {
+		case got := <-events:
+			t.Fatalf("unexpected %s", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	c := dialTest(t, server, nil, true)
+	expect("created", "attached")
+	s := <-created
+	s.Set("user", "alice")
+
+	c.conn.Close()
+	expect("lost")
+
+	c = dialTest(t, server, &HandshakeHead{Token: c.token}, true)
+	defer c.conn.Close()
+	expect("attached", "resumed")
+
+	s.Close("kicked")
+	expect("closed kicked alice")
+}
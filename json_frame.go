@@ -0,0 +1,98 @@
+package kit
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// jsonFrame is the envelope of the json wire mode, one per websocket text frame,
+// e.g. {"type":"request","id":1,"route":"m.echo","body":{"msg":"hi"}}
+type jsonFrame struct {
+	Type  string          `json:"type"`
+	ID    uint            `json:"id,omitempty"`
+	Route string          `json:"route,omitempty"`
+	Body  json.RawMessage `json:"body,omitempty"`
+}
+
+var jsonPacketTypes = map[PacketType]string{
+	PacketHandshake:    "handshake",
+	PacketHandshakeAck: "handshake_ack",
+	PacketHeartbeat:    "heartbeat",
+	PacketClose:        "close",
+}
+
+var jsonMessageTypes = map[MessageType]string{
+	MessageRequest:  "request",
+	MessageNotify:   "notify",
+	MessageResponse: "response",
+	MessagePush:     "push",
+}
+
+func jsonBody(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid(data) {
+		return data
+	}
+	// raw payload, keep it as a json string
+	s, _ := json.Marshal(string(data))
+	return s
+}
+
+// packetToJSONFrame converts a packet written by KitConn
+func packetToJSONFrame(p *Packet) ([]byte, error) {
+	var frame jsonFrame
+
+	if p.Type == PacketData {
+		msg, err := DecodeMessageFromRaw(p.Data)
+		if err != nil {
+			return nil, err
+		}
+		frame = jsonFrame{
+			Type:  jsonMessageTypes[msg.Type],
+			ID:    msg.ID,
+			Route: msg.Route,
+			Body:  jsonBody(msg.Data),
+		}
+	} else {
+		name, ok := jsonPacketTypes[p.Type]
+		if !ok {
+			return nil, ErrWrongPacketType
+		}
+		frame = jsonFrame{Type: name, Body: jsonBody(p.Data)}
+	}
+
+	return json.Marshal(&frame)
+}
+
+// jsonFrameToPacket converts a text frame from client to encoded packet bytes
+func jsonFrameToPacket(data []byte) ([]byte, error) {
+	frame := jsonFrame{}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, fmt.Errorf("kit:invalid json frame %v", err)
+	}
+
+	for t, name := range jsonPacketTypes {
+		if name == frame.Type {
+			return (&Packet{Type: t, Data: frame.Body}).Encode()
+		}
+	}
+
+	for t, name := range jsonMessageTypes {
+		if name == frame.Type {
+			body := []byte(frame.Body)
+			if len(body) == 0 {
+				body = []byte("{}")
+			}
+
+			payload, err := (&Message{Type: t, ID: frame.ID, Route: frame.Route, Data: body}).Encode()
+			if err != nil {
+				return nil, err
+			}
+			return (&Packet{Type: PacketData, Data: payload}).Encode()
+		}
+	}
+
+	return nil, fmt.Errorf("kit:unknown json frame type %s", frame.Type)
+}
@@ -0,0 +1,92 @@
+package kit
+
+import (
+	"testing"
+)
+
+func decodeOnePacket(t *testing.T, b []byte) *Packet {
+	t.Helper()
+	packets, err := NewPacketDecoder().Decode(b)
+	if err != nil || len(packets) != 1 {
+		t.Fatalf("decoded %d packets, error %v", len(packets), err)
+	}
+	return packets[0]
+}
+
+func TestJSONFrameRoundTrip(t *testing.T) {
+	frames := []string{
+		`{"type":"handshake","body":{"version":2}}`,
+		`{"type":"handshake_ack"}`,
+		`{"type":"heartbeat"}`,
+		`{"type":"close","body":{"reason":"bye"}}`,
+		`{"type":"request","id":1,"route":"m.echo","body":{"msg":"hi"}}`,
+		`{"type":"notify","route":"m.sync","body":[1,2]}`,
+		`{"type":"response","id":1,"body":{"msg":"hi"}}`,
+		`{"type":"push","route":"m.tick","body":"raw"}`,
+		// a message without body carries an empty object
+		`{"type":"notify","route":"m.sync","body":{}}`,
+	}
+
+	for _, frame := range frames {
+		b, err := jsonFrameToPacket([]byte(frame))
+		if err != nil {
+			t.Errorf("%s: %v", frame, err)
+			continue
+		}
+		back, err := packetToJSONFrame(decodeOnePacket(t, b))
+		if err != nil {
+			t.Errorf("%s: %v", frame, err)
+			continue
+		}
+		if string(back) != frame {
+			t.Errorf("%s came back as %s", frame, back)
+		}
+	}
+
+	b, err := jsonFrameToPacket([]byte(`{"type":"request","id":2,"route":"m.echo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodeMessageFromRaw(decodeOnePacket(t, b).Data)
+	if err != nil || msg.Type != MessageRequest || msg.ID != 2 || string(msg.Data) != "{}" {
+		t.Fatalf("request without body decoded as %v %v", msg, err)
+	}
+}
+
+func TestPacketToJSONFrame(t *testing.T) {
+	raw, _ := NewMessage(MessagePush, 0, "m.raw", nil).Encode()
+	msg, _ := DecodeMessageFromRaw(raw)
+	msg.Data = []byte("not json")
+	raw, _ = msg.Encode()
+
+	cases := []struct {
+		packet *Packet
+		frame  string
+	}{
+		{&Packet{Type: PacketHeartbeat}, `{"type":"heartbeat"}`},
+		{&Packet{Type: PacketClose, Data: []byte("not json")}, `{"type":"close","body":"not json"}`},
+		{&Packet{Type: PacketData, Data: raw}, `{"type":"push","route":"m.raw","body":"not json"}`},
+	}
+	for _, tc := range cases {
+		frame, err := packetToJSONFrame(tc.packet)
+		if err != nil || string(frame) != tc.frame {
+			t.Errorf("got %s %v, want %s", frame, err, tc.frame)
+		}
+	}
+
+	if _, err := packetToJSONFrame(&Packet{Type: 0x7f}); err != ErrWrongPacketType {
+		t.Errorf("unknown packet type returned %v", err)
+	}
+}
+
+func TestJSONFrameRejected(t *testing.T) {
+	for _, frame := range []string{
+		`{"type":"unknown","body":{}}`,
+		`{"body":{}}`,
+		`not json`,
+	} {
+		if b, err := jsonFrameToPacket([]byte(frame)); err == nil {
+			t.Errorf("%s converted to %q", frame, b)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package kit
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	SetDebug(false)
+}
+
+// waitUntil fails the test if cond is still false after a few seconds
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
+
+// countingStore counts saves
+type countingStore struct {
+	SessionStore
+	mutex sync.Mutex
+	saves int
+}
+
+func (s *countingStore) Save(snapshot *SessionSnapshot) error {
+	s.mutex.Lock()
+	s.saves++
+	s.mutex.Unlock()
+	return s.SessionStore.Save(snapshot)
+}
+
+func (s *countingStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves
+}
+
+// testClient speaks the packet protocol over a net.Pipe
+type testClient struct {
+	t     *testing.T
+	conn  net.Conn
+	dec   *PacketDecoder
+	queue []*Packet
+	token string
+}
+
+// dialTest handshakes with server, the ack is sent when ack is true
+func dialTest(t *testing.T, server *Server, head *HandshakeHead, ack bool) *testClient {
+	t.Helper()
+	c := newTestClient(t, server)
+	resp := c.handshake(head)
+	if resp.Code != CodeOK {
+		t.Fatalf("handshake code %d %s", resp.Code, resp.Error)
+	}
+	if ack {
+		c.send(PacketHandshakeAck, nil)
+	}
+	return c
+}
+
+func newTestClient(t *testing.T, server *Server) *testClient {
+	client, conn := net.Pipe()
+	go NewKitConn(server, conn).Handle()
+	return &testClient{t: t, conn: client, dec: NewPacketDecoder()}
+}
+
+func (c *testClient) handshake(head *HandshakeHead) *HandshakeResponse {
+	c.t.Helper()
+	if head == nil {
+		head = &HandshakeHead{}
+	}
+	if head.Version == 0 {
+		head.Version = ProtocolVersion
+	}
+	hello, _ := json.Marshal(head)
+	c.send(PacketHandshake, hello)
+
+	resp := &HandshakeResponse{}
+	if err := json.Unmarshal(c.read(PacketHandshake).Data, resp); err != nil {
+		c.t.Fatal(err)
+	}
+	c.token = resp.Token
+	return resp
+}
+
+func (c *testClient) send(t PacketType, data []byte) {
+	c.t.Helper()
+	b, _ := (&Packet{Type: t, Data: data}).Encode()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) sendMsg(msgType MessageType, id uint, route string, v interface{}) {
+	c.t.Helper()
+	data, err := NewMessage(msgType, id, route, v).Encode()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(PacketData, data)
+}
+
+// read returns the next packet of type t, others are skipped
+func (c *testClient) read(t PacketType) *Packet {
+	c.t.Helper()
+	for {
+		if p := c.next(); p.Type == t {
+			return p
+		}
+	}
+}
+
+func (c *testClient) next() *Packet {
+	c.t.Helper()
+	buf := make([]byte, 4096)
+	for len(c.queue) == 0 {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		packets, err := c.dec.Decode(buf[:n])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		c.queue = append(c.queue, packets...)
+	}
+
+	p := c.queue[0]
+	c.queue = c.queue[1:]
+	return p
+}
+
+func (c *testClient) readMsg() *Message {
+	c.t.Helper()
+	msg, err := DecodeMessageFromRaw(c.read(PacketData).Data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
@@ -0,0 +1,358 @@
+package kit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	LongPollTimeout     = 25 * time.Second // how long a GET is held without data
+	LongPollIdleTimeout = 60 * time.Second // close the connection if the client stops polling
+	LongPollMaxBuffered = 1 << 20          // bytes waiting for GET or KitConn of a new connection, see pollConn.Write and deliver
+)
+
+// LongPollIdHeader carries the cid of ServeLongPoll, which is as good as the
+// session, so it is kept out of URLs
+const LongPollIdHeader = "X-Kit-Poll-Id"
+
+var errPollConnClosed = errors.New("long poll connection closed")
+
+// pollAddr is the net.Addr of a long poll client
+type pollAddr string
+
+func (a pollAddr) Network() string { return "http" }
+func (a pollAddr) String() string  { return string(a) }
+
+// pollConn is an adapter to net.Conn, bytes written by KitConn are fetched by
+// long-held GET requests and POST bodies are read by KitConn
+type pollConn struct {
+	id            string
+	local         net.Addr
+	remote        net.Addr
+	mutex         sync.Mutex
+	inbound       bytes.Buffer
+	outbound      []byte
+	inReady       chan struct{}
+	outReady      chan struct{}
+	outSpace      chan struct{} // signaled after GET took outbound
+	closed        chan struct{}
+	closeOnce     sync.Once
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lastPoll      time.Time
+	maxBuffered   int // LongPollMaxBuffered when created
+}
+
+func newPollConn(r *http.Request) (*pollConn, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	local := net.Addr(pollAddr(r.Host))
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	}
+
+	return &pollConn{
+		id:          hex.EncodeToString(buf),
+		local:       local,
+		remote:      pollAddr(r.RemoteAddr),
+		inReady:     make(chan struct{}, 1),
+		outReady:    make(chan struct{}, 1),
+		outSpace:    make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+		lastPoll:    time.Now(),
+		maxBuffered: LongPollMaxBuffered,
+	}, nil
+}
+
+// Read blocks until a POST delivers data
+func (c *pollConn) Read(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if c.inbound.Len() > 0 {
+			n, err := c.inbound.Read(b)
+			c.mutex.Unlock()
+			return n, err
+		}
+		deadline := c.readDeadline
+		c.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case <-c.inReady:
+		case <-c.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write queues data for the next GET, it blocks while maxBuffered bytes
+// are waiting, so a client which stops polling fills the write queue of KitConn
+func (c *pollConn) Write(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, errPollConnClosed
+		default:
+		}
+
+		c.mutex.Lock()
+		// a packet larger than the limit is still accepted into an empty buffer
+		if len(c.outbound) == 0 || len(c.outbound)+len(b) <= c.maxBuffered {
+			c.outbound = append(c.outbound, b...)
+			c.mutex.Unlock()
+			signal(c.outReady)
+			return len(b), nil
+		}
+		deadline := c.writeDeadline
+		c.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case <-c.outSpace:
+		case <-c.closed:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *pollConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *pollConn) LocalAddr() net.Addr  { return c.local }
+func (c *pollConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pollConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+func (c *pollConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	// wake up Read to check the new deadline
+	signal(c.inReady)
+	return nil
+}
+
+func (c *pollConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.writeDeadline = t
+	c.mutex.Unlock()
+	// wake up Write to check the new deadline
+	signal(c.outSpace)
+	return nil
+}
+
+// deliver queues a POST body for Read, false if maxBuffered bytes are not read
+// yet, e.g. handlers are slow, the client should retry later
+func (c *pollConn) deliver(data []byte) bool {
+	c.mutex.Lock()
+	if c.inbound.Len() > 0 && c.inbound.Len()+len(data) > c.maxBuffered {
+		c.mutex.Unlock()
+		return false
+	}
+	c.inbound.Write(data)
+	c.mutex.Unlock()
+	signal(c.inReady)
+	return true
+}
+
+// poll waits for outbound data up to timeout, ok is false if the connection is
+// closed and nothing is left
+func (c *pollConn) poll(timeout time.Duration) (data []byte, ok bool) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		c.mutex.Lock()
+		c.lastPoll = time.Now()
+		if len(c.outbound) > 0 {
+			data, c.outbound = c.outbound, nil
+			c.mutex.Unlock()
+			signal(c.outSpace)
+			return data, true
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-c.outReady:
+		case <-c.closed:
+			// flush what was written before closing, e.g. the close packet
+			c.mutex.Lock()
+			data, c.outbound = c.outbound, nil
+			c.mutex.Unlock()
+			return data, len(data) > 0
+		case <-t.C:
+			return nil, true
+		}
+	}
+}
+
+func (c *pollConn) watchIdle() {
+	ticker := time.NewTicker(LongPollIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		idle := time.Since(c.lastPoll)
+		c.mutex.Unlock()
+
+		if idle > LongPollIdleTimeout {
+			Logger.Debugf("long poll %s idle for %v, close", c.remote, idle)
+			c.Close()
+			return
+		}
+	}
+}
+
+func (s *Server) getPollConn(id string) *pollConn {
+	s.pollMutex.Lock()
+	defer s.pollMutex.Unlock()
+	return s.pollConns[id]
+}
+
+// ServeLongPoll is the fallback transport for clients which can not use websocket.
+// POST without cid opens a connection and replies {"cid": "..."}, then with cid in
+// LongPollIdHeader GET receives packets, POST sends packets and DELETE closes it.
+func (s *Server) ServeLongPoll(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	cid := r.Header.Get(LongPollIdHeader)
+	if cid == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "cid is required", http.StatusBadRequest)
+			return
+		}
+		s.openLongPoll(w, r)
+		return
+	}
+
+	c := s.getPollConn(cid)
+	if c == nil {
+		http.Error(w, "connection not found", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := c.poll(LongPollTimeout)
+		if !ok {
+			http.Error(w, "connection closed", http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, PacketMaxSize+PacketHeadLength+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(data) > PacketMaxSize+PacketHeadLength {
+			http.Error(w, ErrPacketSizeExcced.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !c.deliver(data) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many packets not read", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		c.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) openLongPoll(w http.ResponseWriter, r *http.Request) {
+	release, code, err := s.admit(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		Logger.Warnf("long poll from %s rejected: %v", r.RemoteAddr, err)
+		return
+	}
+
+	c, err := newPollConn(r)
+	if err != nil {
+		release()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.pollMutex.Lock()
+	s.pollConns[c.id] = c
+	s.pollMutex.Unlock()
+
+	kitConn := NewKitConn(s, c)
+	kitConn.Identity = peerIdentityFromTLS(r.TLS)
+
+	go c.watchIdle()
+	go func() {
+		defer release()
+		kitConn.Handle()
+
+		s.pollMutex.Lock()
+		delete(s.pollConns, c.id)
+		s.pollMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"cid": c.id})
+}
@@ -0,0 +1,128 @@
+package kit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPollConnWriteBlocksWhenFull(t *testing.T) {
+	c, err := newPollConn(httptest.NewRequest(http.MethodPost, "/poll", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxBuffered = 8
+
+	if _, err := c.Write(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("write to a full buffer returned %v", err)
+	}
+
+	c.SetWriteDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := c.Write(make([]byte, 1))
+		done <- err
+	}()
+	if data, _ := c.poll(time.Second); len(data) != 8 {
+		t.Fatalf("polled %d bytes", len(data))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollConnDeliverLimited(t *testing.T) {
+	c, err := newPollConn(httptest.NewRequest(http.MethodPost, "/poll", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxBuffered = 8
+
+	if !c.deliver(make([]byte, 16)) {
+		t.Fatal("rejected a packet larger than the limit while nothing is buffered")
+	}
+	if c.deliver(make([]byte, 1)) {
+		t.Fatal("accepted data beyond the limit")
+	}
+	if n, _ := c.Read(make([]byte, 16)); n != 16 {
+		t.Fatalf("read %d bytes", n)
+	}
+	if !c.deliver(make([]byte, 8)) {
+		t.Fatal("rejected data after it was read")
+	}
+}
+
+// pollClient drives ServeLongPoll without a real http server
+type pollClient struct {
+	t      *testing.T
+	server *Server
+	cid    string
+}
+
+func (c *pollClient) do(method string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "/poll", bytes.NewReader(body))
+	if c.cid != "" {
+		r.Header.Set(LongPollIdHeader, c.cid)
+	}
+	c.server.ServeLongPoll(w, r)
+	return w
+}
+
+func (c *pollClient) send(t PacketType, data []byte) {
+	b, _ := (&Packet{Type: t, Data: data}).Encode()
+	if w := c.do(http.MethodPost, b); w.Code != http.StatusNoContent {
+		c.t.Fatalf("post returned %d", w.Code)
+	}
+}
+
+func TestLongPollServerClose(t *testing.T) {
+	server := NewServer(NewRoute())
+	attached := make(chan *Session, 1)
+	server.AddHooks(&SessionHooks{
+		OnConnAttached: func(s *Session, c *KitConn) { attached <- s },
+	})
+
+	c := &pollClient{t: t, server: server}
+	w := c.do(http.MethodPost, nil)
+	opened := map[string]string{}
+	json.Unmarshal(w.Body.Bytes(), &opened)
+	c.cid = opened["cid"]
+
+	hello, _ := json.Marshal(&HandshakeHead{Version: ProtocolVersion})
+	c.send(PacketHandshake, hello)
+	if w := c.do(http.MethodGet, nil); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("handshake poll returned %d", w.Code)
+	}
+	c.send(PacketHandshakeAck, nil)
+	session := <-attached
+
+	start := time.Now()
+	session.Close("bye")
+	dec := NewPacketDecoder()
+	for closed := false; !closed; {
+		w := c.do(http.MethodGet, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll returned %d before the close packet", w.Code)
+		}
+		packets, _ := dec.Decode(w.Body.Bytes())
+		for _, p := range packets {
+			closed = closed || p.Type == PacketClose
+		}
+	}
+
+	if w := c.do(http.MethodGet, nil); w.Code != http.StatusGone {
+		t.Fatalf("poll after close returned %d", w.Code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("connection closed after %v", d)
+	}
+}
@@ -62,6 +62,12 @@ type Message struct {
 	ID    uint        // unique id, zero while notify mode
 	Route string      // route for locating service
 	Data  []byte      // payload
+
+	// CoalesceKey is never encoded, an undelivered message with the same key is
+	// replaced by the newer one
+	CoalesceKey string `json:",omitempty"`
+	// Priority is never encoded, it selects the outbound lane
+	Priority Priority `json:",omitempty"`
 }
 
 // String, implementation of fmt.Stringer interface
@@ -0,0 +1,316 @@
+package kit
+
+import (
+	"sync"
+	"time"
+)
+
+type PresenceStatus int
+
+const (
+	PresenceOffline PresenceStatus = iota // no session bound to the user
+	PresenceAway                          // sessions lost connection, waiting for resuming
+	PresenceOnline                        // at least one session is connected
+)
+
+func (s PresenceStatus) String() string {
+	switch s {
+	case PresenceOnline:
+		return "online"
+	case PresenceAway:
+		return "away"
+	default:
+		return "offline"
+	}
+}
+
+// PresenceRoute is the push route of PresenceEvent
+var PresenceRoute = "presence"
+
+// PresenceEvent is pushed to subscribers when the status of a user changes
+type PresenceEvent struct {
+	User   string `json:"user"`
+	Status string `json:"status"`
+}
+
+// Presence tracks online status of users bound to sessions, and pushes changes to
+// sessions subscribing to them
+type Presence struct {
+	// going away is published after Debounce, reconnecting within it is not
+	// published at all, it should be shorter than SessionExpireTimeout
+	Debounce time.Duration
+
+	mutex         sync.Mutex
+	users         map[string]*presenceUser
+	sessionUsers  map[*Session]string
+	watchers      map[string]map[*Session]bool // user -> sessions subscribing to it
+	subscriptions map[*Session]map[string]bool // session -> users it subscribes
+}
+
+type presenceUser struct {
+	sessions map[*Session]bool
+	status   PresenceStatus // the published status
+	timer    *time.Timer    // pending debounced change
+}
+
+// presenceNotice is an event to push after unlocking
+type presenceNotice struct {
+	event    *PresenceEvent
+	watchers []*Session
+}
+
+func (n *presenceNotice) send() {
+	if n == nil {
+		return
+	}
+	for _, s := range n.watchers {
+		s.PushCoalesced(PresenceRoute, n.event.User, n.event)
+	}
+}
+
+// NewPresence creates a Presence tracking sessions of server
+func NewPresence(server *Server) *Presence {
+	p := &Presence{
+		Debounce:      5 * time.Second,
+		users:         make(map[string]*presenceUser),
+		sessionUsers:  make(map[*Session]string),
+		watchers:      make(map[string]map[*Session]bool),
+		subscriptions: make(map[*Session]map[string]bool),
+	}
+
+	server.Route.DeclarePush(PresenceRoute, PresenceEvent{})
+	server.AddHooks(&SessionHooks{
+		OnConnAttached: func(s *Session, c *KitConn) {
+			p.sessionChanged(s)
+		},
+		OnConnLost: p.sessionChanged,
+		OnSessionClosed: func(s *Session, reason string) {
+			p.Unbind(s)
+			p.unsubscribeAll(s)
+		},
+	})
+	return p
+}
+
+// Bind marks the session as one of user, e.g. after login
+func (p *Presence) Bind(s *Session, user string) {
+	p.mutex.Lock()
+	var notices []*presenceNotice
+
+	if old, ok := p.sessionUsers[s]; ok {
+		if old == user {
+			p.mutex.Unlock()
+			return
+		}
+		notices = append(notices, p.detach(s, old))
+	}
+
+	p.sessionUsers[s] = user
+	u, ok := p.users[user]
+	if !ok {
+		u = &presenceUser{sessions: make(map[*Session]bool)}
+		p.users[user] = u
+	}
+	u.sessions[s] = true
+	notices = append(notices, p.refresh(user, u))
+	p.mutex.Unlock()
+
+	for _, n := range notices {
+		n.send()
+	}
+}
+
+// Unbind removes the session from its user, e.g. after logout
+func (p *Presence) Unbind(s *Session) {
+	p.mutex.Lock()
+	user, ok := p.sessionUsers[s]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	notice := p.detach(s, user)
+	p.mutex.Unlock()
+
+	notice.send()
+}
+
+// UserOf returns the user bound to the session, empty if not bound
+func (p *Presence) UserOf(s *Session) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sessionUsers[s]
+}
+
+// Status returns the published status of user
+func (p *Presence) Status(user string) PresenceStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if u, ok := p.users[user]; ok {
+		return u.status
+	}
+	return PresenceOffline
+}
+
+// Subscribe pushes status changes of users to the session until it is closed,
+// the current status of them is returned
+func (p *Presence) Subscribe(s *Session, users ...string) []*PresenceEvent {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	subs, ok := p.subscriptions[s]
+	if !ok {
+		subs = make(map[string]bool)
+		p.subscriptions[s] = subs
+	}
+
+	result := make([]*PresenceEvent, 0, len(users))
+	for _, user := range users {
+		subs[user] = true
+
+		watchers, ok := p.watchers[user]
+		if !ok {
+			watchers = make(map[*Session]bool)
+			p.watchers[user] = watchers
+		}
+		watchers[s] = true
+
+		status := PresenceOffline
+		if u, ok := p.users[user]; ok {
+			status = u.status
+		}
+		result = append(result, &PresenceEvent{User: user, Status: status.String()})
+	}
+	return result
+}
+
+func (p *Presence) Unsubscribe(s *Session, users ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	subs := p.subscriptions[s]
+	for _, user := range users {
+		delete(subs, user)
+		p.removeWatcher(user, s)
+	}
+	if len(subs) == 0 {
+		delete(p.subscriptions, s)
+	}
+}
+
+func (p *Presence) unsubscribeAll(s *Session) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for user := range p.subscriptions[s] {
+		p.removeWatcher(user, s)
+	}
+	delete(p.subscriptions, s)
+}
+
+func (p *Presence) removeWatcher(user string, s *Session) {
+	if watchers, ok := p.watchers[user]; ok {
+		delete(watchers, s)
+		if len(watchers) == 0 {
+			delete(p.watchers, user)
+		}
+	}
+}
+
+func (p *Presence) sessionChanged(s *Session) {
+	p.mutex.Lock()
+	user, ok := p.sessionUsers[s]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	notice := p.refresh(user, p.users[user])
+	p.mutex.Unlock()
+
+	notice.send()
+}
+
+// detach must be called with mutex held
+func (p *Presence) detach(s *Session, user string) *presenceNotice {
+	delete(p.sessionUsers, s)
+	u := p.users[user]
+	delete(u.sessions, s)
+	return p.refresh(user, u)
+}
+
+// refresh publishes the status of user if it is changed, going away is delayed
+// by Debounce. It must be called with mutex held.
+func (p *Presence) refresh(user string, u *presenceUser) *presenceNotice {
+	if u.timer != nil {
+		u.timer.Stop()
+		u.timer = nil
+	}
+
+	status := u.current()
+	if status == u.status {
+		return nil
+	}
+
+	if status == PresenceAway && u.status == PresenceOnline && p.Debounce > 0 {
+		u.timer = time.AfterFunc(p.Debounce, func() {
+			p.settle(user, u)
+		})
+		return nil
+	}
+
+	return p.publish(user, u, status)
+}
+
+func (p *Presence) settle(user string, u *presenceUser) {
+	p.mutex.Lock()
+	if p.users[user] != u || u.timer == nil {
+		// replaced or refreshed meanwhile
+		p.mutex.Unlock()
+		return
+	}
+	u.timer = nil
+
+	var notice *presenceNotice
+	if status := u.current(); status != u.status {
+		notice = p.publish(user, u, status)
+	}
+	p.mutex.Unlock()
+
+	notice.send()
+}
+
+// publish must be called with mutex held
+func (p *Presence) publish(user string, u *presenceUser, status PresenceStatus) *presenceNotice {
+	u.status = status
+	if status == PresenceOffline {
+		delete(p.users, user)
+	}
+
+	Logger.Debugf("presence %s %v", user, status)
+
+	watchers := p.watchers[user]
+	if len(watchers) == 0 {
+		return nil
+	}
+
+	notice := &presenceNotice{
+		event:    &PresenceEvent{User: user, Status: status.String()},
+		watchers: make([]*Session, 0, len(watchers)),
+	}
+	for s := range watchers {
+		notice.watchers = append(notice.watchers, s)
+	}
+	return notice
+}
+
+func (u *presenceUser) current() PresenceStatus {
+	if len(u.sessions) == 0 {
+		return PresenceOffline
+	}
+	for s := range u.sessions {
+		if s.getConn() != nil {
+			return PresenceOnline
+		}
+	}
+	return PresenceAway
+}
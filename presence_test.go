@@ -0,0 +1,157 @@
+package kit
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type presenceTest struct {
+	t        *testing.T
+	server   *Server
+	presence *Presence
+	attached chan *Session
+}
+
+func newPresenceTest(t *testing.T, debounce time.Duration) *presenceTest {
+	server := NewServer(NewRoute())
+	pt := &presenceTest{
+		t:        t,
+		server:   server,
+		presence: NewPresence(server),
+		attached: make(chan *Session, 8),
+	}
+	pt.presence.Debounce = debounce
+	server.AddHooks(&SessionHooks{
+		OnConnAttached: func(s *Session, c *KitConn) {
+			pt.attached <- s
+		},
+	})
+	return pt
+}
+
+// dial connects a client and returns its session
+func (pt *presenceTest) dial(head *HandshakeHead) (*testClient, *Session) {
+	pt.t.Helper()
+	c := dialTest(pt.t, pt.server, head, true)
+	select {
+	case s := <-pt.attached:
+		return c, s
+	case <-time.After(5 * time.Second):
+		pt.t.Fatal("session not attached")
+		return nil, nil
+	}
+}
+
+// expect reads the next presence event pushed to c
+func (pt *presenceTest) expect(c *testClient, user string, status PresenceStatus) {
+	pt.t.Helper()
+	msg := c.readMsg()
+	event := PresenceEvent{}
+	json.Unmarshal(msg.Data, &event)
+	if msg.Route != PresenceRoute || event.User != user || event.Status != status.String() {
+		pt.t.Fatalf("got %s %s, want %s %v", msg.Route, msg.Data, user, status)
+	}
+}
+
+// expectNothing fails if anything was pushed to c before a marker pushed now
+func (pt *presenceTest) expectNothing(c *testClient, s *Session) {
+	pt.t.Helper()
+	s.Push("marker", nil)
+	if msg := c.readMsg(); msg.Route != "marker" {
+		pt.t.Fatalf("unexpected push %s %s", msg.Route, msg.Data)
+	}
+}
+
+func TestPresenceDebounce(t *testing.T) {
+	pt := newPresenceTest(t, 200*time.Millisecond)
+	p := pt.presence
+
+	w, watcher := pt.dial(nil)
+	defer w.conn.Close()
+	p.Subscribe(watcher, "alice")
+
+	a, alice := pt.dial(nil)
+	p.Bind(alice, "alice")
+	pt.expect(w, "alice", PresenceOnline)
+
+	// lost and resumed within Debounce
+	a.conn.Close()
+	waitUntil(t, func() bool { return alice.getConn() == nil })
+	if status := p.Status("alice"); status != PresenceOnline {
+		t.Fatalf("away published within debounce, status %v", status)
+	}
+	a, resumed := pt.dial(&HandshakeHead{Token: a.token})
+	defer a.conn.Close()
+	if resumed != alice {
+		t.Fatal("session not resumed")
+	}
+	time.Sleep(2 * p.Debounce)
+	pt.expectNothing(w, watcher)
+	if status := p.Status("alice"); status != PresenceOnline {
+		t.Fatalf("status %v after resuming", status)
+	}
+}
+
+func TestPresencePublish(t *testing.T) {
+	pt := newPresenceTest(t, 20*time.Millisecond)
+	p := pt.presence
+
+	w, watcher := pt.dial(nil)
+	defer w.conn.Close()
+	a, alice := pt.dial(nil)
+	p.Bind(alice, "alice")
+
+	events := p.Subscribe(watcher, "alice", "bob")
+	if len(events) != 2 || events[0].Status != "online" || events[1].Status != "offline" {
+		t.Fatalf("subscribed %v %v", events[0], events[1])
+	}
+
+	a.conn.Close()
+	pt.expect(w, "alice", PresenceAway)
+	if status := p.Status("alice"); status != PresenceAway {
+		t.Fatalf("status %v after debounce", status)
+	}
+
+	a, _ = pt.dial(&HandshakeHead{Token: a.token})
+	defer a.conn.Close()
+	pt.expect(w, "alice", PresenceOnline)
+
+	alice.Close("bye")
+	pt.expect(w, "alice", PresenceOffline)
+	if status := p.Status("alice"); status != PresenceOffline {
+		t.Fatalf("status %v after close", status)
+	}
+
+	b, bob := pt.dial(nil)
+	defer b.conn.Close()
+	p.Bind(bob, "bob")
+	pt.expect(w, "bob", PresenceOnline)
+}
+
+func TestPresenceCleanup(t *testing.T) {
+	pt := newPresenceTest(t, time.Hour)
+	p := pt.presence
+
+	w, watcher := pt.dial(nil)
+	defer w.conn.Close()
+	a, alice := pt.dial(nil)
+	defer a.conn.Close()
+	p.Bind(alice, "alice")
+	p.Bind(watcher, "bob")
+	p.Subscribe(watcher, "alice")
+	p.Subscribe(alice, "bob")
+
+	// closing a lost session publishes offline without waiting for Debounce
+	a.conn.Close()
+	waitUntil(t, func() bool { return alice.getConn() == nil })
+	alice.Close("expired")
+	pt.expect(w, "alice", PresenceOffline)
+
+	watcher.Close("bye")
+	waitUntil(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return len(p.users)+len(p.sessionUsers)+len(p.watchers)+len(p.subscriptions) == 0
+	})
+}
@@ -1,5 +1,7 @@
 package kit
 
+import "fmt"
+
 type RequestHeader interface {
 	SetMsgId(id uint)
 	GetMsgId() uint
@@ -16,3 +18,33 @@ func (req *RequestHead) SetMsgId(id uint) {
 func (req *RequestHead) GetMsgId() uint {
 	return req.MsgId
 }
+
+// Response codes of ErrorResponse
+const (
+	CodeOK                  = 200
+	CodeBadRequest          = 400
+	CodeForbidden           = 403 // not a member of the room, see RoomTarget
+	CodeNotFound            = 404
+	CodeTooManyRequests     = 429
+	CodeNoResponse          = 504
+	CodeEncryptionRequired  = 426 // handshake rejected, CapabilityEncryption is required
+	CodeVersionNotSupported = 505 // handshake rejected, protocol version too old
+)
+
+// ErrorResponse is sent back when a request can not be handled
+type ErrorResponse struct {
+	Code   int          `json:"code"`
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"` // set when validation failed
+}
+
+// RequestError is returned by Session.Request when the client replies with an
+// error code
+type RequestError struct {
+	Code    int
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request error %d %s", e.Code, e.Message)
+}
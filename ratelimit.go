@@ -0,0 +1,244 @@
+package kit
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitAction is what to do with a message exceeding the rate limit
+type RateLimitAction int
+
+const (
+	RateLimitDrop  RateLimitAction = iota // ignore the message silently
+	RateLimitReply                        // reply CodeTooManyRequests to requests, drop notifies
+	RateLimitKick                         // close the session
+)
+
+// RateLimit allows Rate messages per second with bursts up to Burst, zero Rate
+// means unlimited
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type RateLimitConfig struct {
+	Global  RateLimit            // shared by all sessions
+	Session RateLimit            // per session, all routes
+	Routes  map[string]RateLimit // per session and route, e.g. "chat.send": {5, 5}
+	Action  RateLimitAction
+}
+
+// RateLimitStats are counters since SetRateLimit
+type RateLimitStats struct {
+	Allowed uint64
+	Limited uint64
+	Kicked  uint64
+	Routes  map[string]uint64 // limited count by route, unregistered routes under RateLimitUnknownRoute
+}
+
+// RateLimitUnknownRoute is the key in RateLimitStats.Routes counting all routes
+// without a handler, so clients can not grow the stats with made up routes
+const RateLimitUnknownRoute = "(unknown)"
+
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   l.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill should be called with mutex held
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allowAll takes a token from every bucket only if all of them have one, so a
+// message rejected by one bucket is not charged to the others. nil buckets are
+// unlimited, buckets are always locked in the order given.
+func allowAll(now time.Time, buckets ...*tokenBucket) bool {
+	for _, b := range buckets {
+		if b != nil {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+		}
+	}
+
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.refill(now)
+		if b.tokens < 1 {
+			return false
+		}
+	}
+
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true
+}
+
+type rateLimiter struct {
+	config  *RateLimitConfig
+	global  *tokenBucket
+	allowed uint64
+	limited uint64
+	kicked  uint64
+
+	routeMutex   sync.Mutex
+	routeLimited map[string]uint64
+}
+
+// sessionLimiter lives in Session, so it survives reconnects
+type sessionLimiter struct {
+	session *tokenBucket
+	mutex   sync.Mutex
+	routes  map[string]*tokenBucket
+}
+
+func newRateLimiter(config *RateLimitConfig) *rateLimiter {
+	c := *config
+	c.Routes = make(map[string]RateLimit)
+	for route, l := range config.Routes {
+		c.Routes[strings.ToLower(route)] = l
+	}
+
+	return &rateLimiter{
+		config:       &c,
+		global:       newTokenBucket(c.Global),
+		routeLimited: make(map[string]uint64),
+	}
+}
+
+func (l *rateLimiter) sessionLimiter(s *Session) *sessionLimiter {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.limiter == nil {
+		s.limiter = &sessionLimiter{
+			session: newTokenBucket(l.config.Session),
+			routes:  make(map[string]*tokenBucket),
+		}
+	}
+	return s.limiter
+}
+
+// allow checks route, session and global buckets, known is false if route has no
+// handler
+func (l *rateLimiter) allow(s *Session, route string, known bool) bool {
+	now := time.Now()
+	sl := l.sessionLimiter(s)
+
+	var routeBucket *tokenBucket
+	if rl, has := l.config.Routes[route]; has {
+		sl.mutex.Lock()
+		b, exists := sl.routes[route]
+		if !exists {
+			b = newTokenBucket(rl)
+			sl.routes[route] = b
+		}
+		sl.mutex.Unlock()
+		routeBucket = b
+	}
+
+	if allowAll(now, routeBucket, sl.session, l.global) {
+		atomic.AddUint64(&l.allowed, 1)
+		return true
+	}
+
+	if !known {
+		route = RateLimitUnknownRoute
+	}
+	atomic.AddUint64(&l.limited, 1)
+	l.routeMutex.Lock()
+	l.routeLimited[route]++
+	l.routeMutex.Unlock()
+	return false
+}
+
+func (l *rateLimiter) stats() RateLimitStats {
+	stats := RateLimitStats{
+		Allowed: atomic.LoadUint64(&l.allowed),
+		Limited: atomic.LoadUint64(&l.limited),
+		Kicked:  atomic.LoadUint64(&l.kicked),
+		Routes:  make(map[string]uint64),
+	}
+
+	l.routeMutex.Lock()
+	for route, n := range l.routeLimited {
+		stats.Routes[route] = n
+	}
+	l.routeMutex.Unlock()
+	return stats
+}
+
+// SetRateLimit enables rate limiting of incoming messages, it should be called
+// before serving. nil disables it.
+func (s *Server) SetRateLimit(config *RateLimitConfig) {
+	if config == nil {
+		s.rateLimiter = nil
+		return
+	}
+	s.rateLimiter = newRateLimiter(config)
+}
+
+// RateLimitStats returns the counters of rate limiting
+func (s *Server) RateLimitStats() RateLimitStats {
+	if s.rateLimiter == nil {
+		return RateLimitStats{}
+	}
+	return s.rateLimiter.stats()
+}
+
+// checkRateLimit returns false if msg should not be dispatched
+func (s *Server) checkRateLimit(session *Session, msg *Message) bool {
+	l := s.rateLimiter
+	if l == nil {
+		return true
+	}
+	_, known := s.Route.rules[msg.Route]
+	if l.allow(session, msg.Route, known) {
+		return true
+	}
+
+	Logger.Debugf("%v route %s exceeds rate limit", session, msg.Route)
+
+	switch l.config.Action {
+	case RateLimitReply:
+		if msg.Type == MessageRequest {
+			session.expectResponse(msg.ID)
+			session.respondError(msg.ID, CodeTooManyRequests, "rate limit exceeded")
+		}
+	case RateLimitKick:
+		atomic.AddUint64(&l.kicked, 1)
+		session.Close("rate limit exceeded")
+	}
+	return false
+}
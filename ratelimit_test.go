@@ -0,0 +1,50 @@
+package kit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRateLimitRejectedConsumesNothing(t *testing.T) {
+	server := NewServer(NewRoute())
+	server.SetRateLimit(&RateLimitConfig{
+		Global:  RateLimit{Rate: 0.001, Burst: 1},
+		Session: RateLimit{Rate: 0.001, Burst: 2},
+	})
+	s := server.SessionManager.createSession()
+	msg := &Message{Type: MessageNotify, Route: "a.b"}
+
+	if !server.checkRateLimit(s, msg) {
+		t.Fatal("first message limited")
+	}
+	for i := 0; i < 5; i++ {
+		if server.checkRateLimit(s, msg) {
+			t.Fatal("global limit not applied")
+		}
+	}
+
+	s.limiter.session.mutex.Lock()
+	defer s.limiter.session.mutex.Unlock()
+	if s.limiter.session.tokens < 1 {
+		t.Fatalf("messages rejected by the global limit took session tokens, %v left", s.limiter.session.tokens)
+	}
+}
+
+func TestRateLimitUnknownRoutes(t *testing.T) {
+	route := NewRoute()
+	route.Reg("test", &Asker{})
+	server := NewServer(route)
+	server.SetRateLimit(&RateLimitConfig{Session: RateLimit{Rate: 0.001, Burst: 1}})
+	s := server.SessionManager.createSession()
+
+	server.checkRateLimit(s, &Message{Type: MessageNotify, Route: "test.ask"})
+	server.checkRateLimit(s, &Message{Type: MessageNotify, Route: "test.ask"})
+	for i := 0; i < 100; i++ {
+		server.checkRateLimit(s, &Message{Type: MessageNotify, Route: fmt.Sprintf("made.up%d", i)})
+	}
+
+	stats := server.RateLimitStats()
+	if len(stats.Routes) != 2 || stats.Routes["test.ask"] != 1 || stats.Routes[RateLimitUnknownRoute] != 100 {
+		t.Fatalf("unexpected route stats %v", stats.Routes)
+	}
+}
@@ -0,0 +1,171 @@
+package kit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidResumeToken = errors.New("kit:invalid resume token")
+	ErrResumeTokenExpired = errors.New("kit:resume token expired")
+)
+
+const resumeNonceSize = 16
+
+// hkdf info of resume token keys
+var (
+	hkdfInfoResumeEncrypt = []byte("kit resume token encrypt")
+	hkdfInfoResumeSign    = []byte("kit resume token sign")
+)
+
+// resume token layout, base64url without padding:
+//   iv(16) | aes-ctr(expire(8) | nonce(16) | session id) | hmac-sha256(iv | ciphertext)
+// the session id is encrypted so it never leaves the server, the nonce is kept by
+// the session and replaced on every resumption so a token works only once. The
+// previous one still works for Server.ResumeGrace until the new one is used, in
+// case the client never got the new token, e.g. the handshake response was lost.
+
+func newResumeSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func (s *Server) resumeKeys() (encKey, signKey []byte) {
+	return hkdfSHA256(s.ResumeSecret, nil, hkdfInfoResumeEncrypt, 32),
+		hkdfSHA256(s.ResumeSecret, nil, hkdfInfoResumeSign, 32)
+}
+
+func (s *Server) encodeResumeToken(id string, nonce []byte, expire time.Time) string {
+	encKey, signKey := s.resumeKeys()
+
+	plain := make([]byte, 8, 8+len(nonce)+len(id))
+	binary.BigEndian.PutUint64(plain, uint64(expire.Unix()))
+	plain = append(plain, nonce...)
+	plain = append(plain, id...)
+
+	token := make([]byte, aes.BlockSize+len(plain), aes.BlockSize+len(plain)+sha256.Size)
+	iv := token[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		panic(err)
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		panic(err)
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(token[aes.BlockSize:], plain)
+
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write(token)
+	token = mac.Sum(token)
+
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func (s *Server) decodeResumeToken(token string) (id string, nonce []byte, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < aes.BlockSize+8+resumeNonceSize+sha256.Size {
+		return "", nil, ErrInvalidResumeToken
+	}
+
+	encKey, signKey := s.resumeKeys()
+
+	body, sum := raw[:len(raw)-sha256.Size], raw[len(raw)-sha256.Size:]
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write(body)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", nil, ErrInvalidResumeToken
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return "", nil, err
+	}
+	plain := make([]byte, len(body)-aes.BlockSize)
+	cipher.NewCTR(block, body[:aes.BlockSize]).XORKeyStream(plain, body[aes.BlockSize:])
+
+	expire := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	if time.Now().After(expire) {
+		return "", nil, ErrResumeTokenExpired
+	}
+
+	nonce = plain[8 : 8+resumeNonceSize]
+	id = string(plain[8+resumeNonceSize:])
+	return id, nonce, nil
+}
+
+// issueResumeToken rotates the nonce of session and returns a token of it,
+// tokens issued before are invalid from now on
+func (s *Server) issueResumeToken(session *Session) string {
+	nonce, _ := session.renewResumeNonce(nil, 0)
+	return s.encodeResumeToken(session.Id, nonce, time.Now().Add(s.ResumeTokenTTL))
+}
+
+// resumeSession finds the session of token, nil if the token is invalid, the
+// session is gone or the session is bound to another client certificate. The
+// token is consumed and a new one is returned.
+func (s *Server) resumeSession(token string, identity *PeerIdentity) (*Session, string) {
+	id, nonce, err := s.decodeResumeToken(token)
+	if err != nil {
+		Logger.Debugf("resume token rejected: %v", err)
+		return nil, ""
+	}
+
+	session := s.SessionManager.resumeSession(id)
+	if session == nil {
+		return nil, ""
+	}
+
+	if !session.acceptsIdentity(identity) {
+		Logger.Warnf("identity %v mismatches %v", identity, session)
+		return nil, ""
+	}
+
+	next, ok := session.renewResumeNonce(nonce, s.ResumeGrace)
+	if !ok {
+		Logger.Warnf("stale resume token of %v", session)
+		return nil, ""
+	}
+	return session, s.encodeResumeToken(session.Id, next, time.Now().Add(s.ResumeTokenTTL))
+}
+
+// renewResumeNonce replaces the resume nonce, unless old is given and matches
+// neither the current one nor the previous one within its grace. Using the
+// current one keeps it as the previous one for grace, and invalidates the one
+// before it.
+func (s *Session) renewResumeNonce(old []byte, grace time.Duration) ([]byte, bool) {
+	nonce := make([]byte, resumeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case old == nil:
+		s.prevResumeNonce = nil
+	case hmac.Equal(old, s.resumeNonce):
+		s.prevResumeNonce = nil
+		if grace > 0 {
+			s.prevResumeNonce = s.resumeNonce
+			s.prevResumeExpire = time.Now().Add(grace)
+		}
+	case s.prevResumeNonce != nil && hmac.Equal(old, s.prevResumeNonce) && time.Now().Before(s.prevResumeExpire):
+		// retried with the previous token, the unused one issued for it is dropped
+	default:
+		return nil, false
+	}
+	s.resumeNonce = nonce
+	return nonce, true
+}
@@ -0,0 +1,83 @@
+package kit
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRestoredSessionKeepsIdentity(t *testing.T) {
+	store := NewMemorySessionStore()
+	owner := &PeerIdentity{Certificate: &x509.Certificate{Raw: []byte("owner")}}
+	other := &PeerIdentity{Certificate: &x509.Certificate{Raw: []byte("other")}}
+
+	server := NewServer(NewRoute())
+	server.SessionManager.Store = store
+	s := server.SessionManager.createSession()
+	s.Lock()
+	s.identity = owner
+	s.certHash = owner.Fingerprint()
+	s.Unlock()
+	token := server.issueResumeToken(s)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// another node sharing the store restores it
+	for _, identity := range []*PeerIdentity{nil, other} {
+		node := NewServer(NewRoute())
+		node.ResumeSecret = server.ResumeSecret
+		node.SessionManager.Store = store
+		if restored, _ := node.resumeSession(token, identity); restored != nil {
+			t.Fatalf("%v resumed a session bound to %v", identity, owner)
+		}
+	}
+
+	node := NewServer(NewRoute())
+	node.ResumeSecret = server.ResumeSecret
+	node.SessionManager.Store = store
+	if restored, _ := node.resumeSession(token, owner); restored == nil {
+		t.Fatal("owner could not resume its session")
+	}
+}
+
+func TestResumeGrace(t *testing.T) {
+	server := NewServer(NewRoute())
+	s := server.SessionManager.createSession()
+	first := server.issueResumeToken(s)
+
+	resume := func(token string) string {
+		t.Helper()
+		restored, next := server.resumeSession(token, nil)
+		if restored != s {
+			t.Fatal("token rejected")
+		}
+		return next
+	}
+	reject := func(token, why string) {
+		t.Helper()
+		if restored, _ := server.resumeSession(token, nil); restored != nil {
+			t.Fatalf("token accepted %s", why)
+		}
+	}
+
+	// the response of the first resumption is lost, the client retries
+	lost := resume(first)
+	second := resume(first)
+	reject(lost, "after the previous one was used again")
+	third := resume(second)
+	reject(first, "after the next one was used")
+	resume(third)
+
+	server.ResumeGrace = 0
+	fourth := resume(server.issueResumeToken(s))
+	reject(third, "after reissued")
+	resume(fourth)
+	reject(fourth, "twice without grace")
+
+	server.ResumeGrace = 10 * time.Millisecond
+	fifth := server.issueResumeToken(s)
+	resume(fifth)
+	time.Sleep(20 * time.Millisecond)
+	reject(fifth, "after the grace")
+}
@@ -0,0 +1,471 @@
+package kit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRoomExists    = errors.New("room already existed")
+	ErrRoomFull      = errors.New("room is full")
+	ErrRoomDestroyed = errors.New("room destroyed")
+)
+
+// RoomTarget is implemented by requests of handlers which run in the executor of
+// a room, embed RoomHead to implement it. Only members of the room could send
+// them, unless the request implements RoomOpenTarget.
+type RoomTarget interface {
+	GetRoomId() string
+}
+
+type RoomHead struct {
+	RoomId string `json:"room"`
+}
+
+func (h *RoomHead) GetRoomId() string {
+	return h.RoomId
+}
+
+// RoomOpenTarget is a RoomTarget which non members could send too, such as
+// joining the room, embed RoomOpenHead to implement it
+type RoomOpenTarget interface {
+	RoomTarget
+	RoomOpen() bool
+}
+
+type RoomOpenHead struct {
+	RoomHead
+}
+
+func (h *RoomOpenHead) RoomOpen() bool {
+	return true
+}
+
+// RoomHooks are called in the executor of the room, nil funcs are skipped
+type RoomHooks struct {
+	OnJoin       func(r *Room, s *Session)
+	OnLeave      func(r *Room, s *Session) // left or the session is closed
+	OnDisconnect func(r *Room, s *Session) // a member lost connection, it is still a member
+	OnResume     func(r *Room, s *Session) // a member is back after disconnected
+	OnDestroy    func(r *Room)
+}
+
+// RoomManager keeps rooms of a server, handlers with RoomTarget requests run in
+// the executor of the room
+type RoomManager struct {
+	// rooms staying empty for EmptyTimeout are destroyed, zero disables it
+	EmptyTimeout time.Duration
+
+	mutex        sync.Mutex
+	rooms        map[string]*Room
+	sessionRooms map[*Session]map[*Room]bool // changed with the mutex of the room held
+}
+
+func NewRoomManager(server *Server) *RoomManager {
+	m := &RoomManager{
+		EmptyTimeout: 30 * time.Second,
+		rooms:        make(map[string]*Room),
+		sessionRooms: make(map[*Session]map[*Room]bool),
+	}
+
+	server.Route.rooms = m
+	server.AddHooks(&SessionHooks{
+		OnConnLost: func(s *Session) {
+			for _, r := range m.RoomsOf(s) {
+				r.fire(func(h *RoomHooks) func(*Room, *Session) { return h.OnDisconnect }, s)
+			}
+		},
+		OnSessionResumed: func(s *Session, c *KitConn) {
+			for _, r := range m.RoomsOf(s) {
+				r.fire(func(h *RoomHooks) func(*Room, *Session) { return h.OnResume }, s)
+			}
+		},
+		OnSessionClosed: func(s *Session, reason string) {
+			for _, r := range m.RoomsOf(s) {
+				r.Leave(s)
+			}
+		},
+	})
+	return m
+}
+
+// CreateRoom creates an empty room, capacity zero means unlimited
+func (m *RoomManager) CreateRoom(id string, capacity int, hooks *RoomHooks) (*Room, error) {
+	if hooks == nil {
+		hooks = &RoomHooks{}
+	}
+
+	m.mutex.Lock()
+	if _, ok := m.rooms[id]; ok {
+		m.mutex.Unlock()
+		return nil, ErrRoomExists
+	}
+
+	r := &Room{
+		Id:       id,
+		Capacity: capacity,
+		Manager:  m,
+		hooks:    hooks,
+		exec:     newSerialExecutor(),
+		members:  make(map[*Session]bool),
+		data:     make(map[string]interface{}),
+	}
+	m.rooms[id] = r
+	m.mutex.Unlock()
+
+	Logger.Debugf("%v created", r)
+
+	r.mutex.Lock()
+	r.checkEmpty()
+	r.mutex.Unlock()
+	return r, nil
+}
+
+func (m *RoomManager) GetRoom(id string) *Room {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.rooms[id]
+}
+
+// RoomsOf returns rooms the session is a member of
+func (m *RoomManager) RoomsOf(s *Session) []*Room {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rooms := make([]*Room, 0, len(m.sessionRooms[s]))
+	for r := range m.sessionRooms[s] {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+func (m *RoomManager) RoomCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.rooms)
+}
+
+func (m *RoomManager) addMember(r *Room, s *Session) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rooms, ok := m.sessionRooms[s]
+	if !ok {
+		rooms = make(map[*Room]bool)
+		m.sessionRooms[s] = rooms
+	}
+	rooms[r] = true
+}
+
+func (m *RoomManager) removeMember(r *Room, s *Session) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if rooms, ok := m.sessionRooms[s]; ok {
+		delete(rooms, r)
+		if len(rooms) == 0 {
+			delete(m.sessionRooms, s)
+		}
+	}
+}
+
+func (m *RoomManager) removeRoom(r *Room) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.rooms[r.Id] == r {
+		delete(m.rooms, r.Id)
+	}
+}
+
+// Room is a group of sessions with its own state and a serial executor, hooks
+// and handlers of the room run one by one in the executor
+type Room struct {
+	Id       string
+	Capacity int
+	Manager  *RoomManager
+
+	hooks      *RoomHooks
+	exec       *serialExecutor
+	mutex      sync.RWMutex
+	members    map[*Session]bool
+	data       map[string]interface{}
+	destroyed  bool
+	emptyTimer *time.Timer
+	tasks      taskSet
+}
+
+func (r *Room) String() string {
+	return "Room(" + r.Id + ")"
+}
+
+// Join adds the session, joining twice is a no-op
+func (r *Room) Join(s *Session) error {
+	r.mutex.Lock()
+	if r.destroyed {
+		r.mutex.Unlock()
+		return ErrRoomDestroyed
+	}
+	if r.members[s] {
+		r.mutex.Unlock()
+		return nil
+	}
+	if r.Capacity > 0 && len(r.members) >= r.Capacity {
+		r.mutex.Unlock()
+		return ErrRoomFull
+	}
+
+	r.members[s] = true
+	if r.emptyTimer != nil {
+		r.emptyTimer.Stop()
+		r.emptyTimer = nil
+	}
+	// under r.mutex, so it is not re-added after a concurrent Leave or Destroy
+	r.Manager.addMember(r, s)
+	r.mutex.Unlock()
+
+	Logger.Debugf("%v join %v", s, r)
+	r.fire(func(h *RoomHooks) func(*Room, *Session) { return h.OnJoin }, s)
+	return nil
+}
+
+func (r *Room) Leave(s *Session) {
+	r.mutex.Lock()
+	if !r.members[s] {
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.members, s)
+	r.Manager.removeMember(r, s)
+	r.checkEmpty()
+	r.mutex.Unlock()
+
+	Logger.Debugf("%v leave %v", s, r)
+	r.fire(func(h *RoomHooks) func(*Room, *Session) { return h.OnLeave }, s)
+}
+
+func (r *Room) IsMember(s *Session) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.members[s]
+}
+
+func (r *Room) Members() []*Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	members := make([]*Session, 0, len(r.members))
+	for s := range r.members {
+		members = append(members, s)
+	}
+	return members
+}
+
+func (r *Room) Count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.members)
+}
+
+func (r *Room) Set(key string, value interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.data[key] = value
+}
+
+func (r *Room) HasKey(key string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	_, has := r.data[key]
+	return has
+}
+
+func (r *Room) Value(key string) interface{} {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.data[key]
+}
+
+// Broadcast pushes v to all members except the excluded ones, v is encoded once
+func (r *Room) Broadcast(route string, v interface{}, exclude ...*Session) {
+	msg := NewMessage(MessagePush, 0, route, v)
+
+	for _, s := range r.Members() {
+		skip := false
+		for _, e := range exclude {
+			if e == s {
+				skip = true
+				break
+			}
+		}
+
+		if skip || s.isClosed() {
+			continue
+		}
+		if err := s.writeMsg(msg); err != nil {
+			Logger.Debugf("%v broadcast to %v error %v", r, s, err)
+		}
+	}
+}
+
+// Post runs fn in the executor of the room
+func (r *Room) Post(fn func()) error {
+	if !r.exec.post(fn) {
+		return ErrRoomDestroyed
+	}
+	return nil
+}
+
+// Do runs fn in the executor of the room and waits for it, never call it from
+// the executor itself
+func (r *Room) Do(fn func()) error {
+	done := make(chan struct{})
+	err := r.Post(func() {
+		defer close(done)
+		fn()
+	})
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// Destroy removes all members and the room from manager, OnDestroy is the last
+// hook called in the executor
+func (r *Room) Destroy() {
+	r.mutex.Lock()
+	if r.destroyed {
+		r.mutex.Unlock()
+		return
+	}
+	r.destroyed = true
+	if r.emptyTimer != nil {
+		r.emptyTimer.Stop()
+		r.emptyTimer = nil
+	}
+	for s := range r.members {
+		r.Manager.removeMember(r, s)
+	}
+	r.members = make(map[*Session]bool)
+	r.mutex.Unlock()
+
+	r.Manager.removeRoom(r)
+	r.tasks.stopAll()
+
+	if h := r.hooks.OnDestroy; h != nil {
+		r.exec.post(func() { h(r) })
+	}
+	r.exec.close()
+	Logger.Debugf("%v destroyed", r)
+}
+
+func (r *Room) IsDestroyed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.destroyed
+}
+
+// checkEmpty schedules destroying the empty room, it must be called with mutex held
+func (r *Room) checkEmpty() {
+	if len(r.members) > 0 || r.destroyed || r.emptyTimer != nil {
+		return
+	}
+
+	timeout := r.Manager.EmptyTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	r.emptyTimer = time.AfterFunc(timeout, func() {
+		r.mutex.Lock()
+		empty := len(r.members) == 0
+		r.emptyTimer = nil
+		r.mutex.Unlock()
+
+		if empty {
+			Logger.Debugf("%v empty for %v", r, timeout)
+			r.Destroy()
+		}
+	})
+}
+
+func (r *Room) fire(hook func(h *RoomHooks) func(*Room, *Session), s *Session) {
+	if h := hook(r.hooks); h != nil {
+		r.exec.post(func() { h(r, s) })
+	}
+}
+
+// serialExecutor runs posted funcs one by one in its own goroutine
+type serialExecutor struct {
+	mutex  sync.Mutex
+	tasks  []func()
+	ready  chan struct{}
+	closed bool
+}
+
+func newSerialExecutor() *serialExecutor {
+	e := &serialExecutor{ready: make(chan struct{}, 1)}
+	go e.run()
+	return e
+}
+
+func (e *serialExecutor) post(fn func()) bool {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return false
+	}
+	e.tasks = append(e.tasks, fn)
+	e.mutex.Unlock()
+
+	signal(e.ready)
+	return true
+}
+
+// close rejects new funcs, funcs already posted still run
+func (e *serialExecutor) close() {
+	e.mutex.Lock()
+	e.closed = true
+	e.mutex.Unlock()
+
+	signal(e.ready)
+}
+
+func (e *serialExecutor) run() {
+	for range e.ready {
+		for {
+			e.mutex.Lock()
+			if len(e.tasks) == 0 {
+				closed := e.closed
+				e.mutex.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			fn := e.tasks[0]
+			e.tasks[0] = nil
+			e.tasks = e.tasks[1:]
+			e.mutex.Unlock()
+
+			e.call(fn)
+		}
+	}
+}
+
+// call keeps the executor running when fn panics
+func (e *serialExecutor) call(fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			Logger.Errorw("room executor panic", "error", err, zap.Stack("stack"))
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,135 @@
+package kit
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+type Game struct {
+	rooms *RoomManager
+}
+
+type GameJoinReq struct {
+	RequestHead
+	RoomOpenHead
+}
+
+type GameReq struct {
+	RequestHead
+	RoomHead
+}
+
+type GameNotify struct {
+	RoomHead
+}
+
+func (h *Game) Join(s *Session, r *GameJoinReq) {
+	if err := h.rooms.GetRoom(r.RoomId).Join(s); err != nil {
+		s.ResponseError(r, CodeBadRequest, err.Error())
+		return
+	}
+	s.Response(r, struct{}{})
+}
+
+func (h *Game) Say(s *Session, r *GameReq) {
+	s.Response(r, struct{}{})
+}
+
+func (h *Game) Boom(s *Session, r *GameNotify) {
+	panic("boom")
+}
+
+func newGameClient(t *testing.T) *testClient {
+	route := NewRoute()
+	h := &Game{}
+	route.Reg("game", h)
+	server := NewServer(route)
+	h.rooms = NewRoomManager(server)
+	if _, err := h.rooms.CreateRoom("r1", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	return dialTest(t, server, nil, true)
+}
+
+func (c *testClient) requestCode(id uint, route string, v interface{}) int {
+	c.t.Helper()
+	c.sendMsg(MessageRequest, id, route, v)
+	msg := c.readMsg()
+	if msg.ID != id {
+		c.t.Fatalf("response id %d, want %d", msg.ID, id)
+	}
+	resp := ErrorResponse{}
+	json.Unmarshal(msg.Data, &resp)
+	if resp.Code == 0 {
+		return CodeOK
+	}
+	return resp.Code
+}
+
+func TestRoomRequiresMember(t *testing.T) {
+	c := newGameClient(t)
+	defer c.conn.Close()
+
+	if code := c.requestCode(1, "game.say", &GameReq{RoomHead: RoomHead{RoomId: "r1"}}); code != CodeForbidden {
+		t.Fatalf("non member got %d", code)
+	}
+	if code := c.requestCode(2, "game.join", &GameJoinReq{RoomOpenHead: RoomOpenHead{RoomHead{RoomId: "r1"}}}); code != CodeOK {
+		t.Fatalf("join got %d", code)
+	}
+	if code := c.requestCode(3, "game.say", &GameReq{RoomHead: RoomHead{RoomId: "r1"}}); code != CodeOK {
+		t.Fatalf("member got %d", code)
+	}
+}
+
+func TestRoomExecutorRecovers(t *testing.T) {
+	c := newGameClient(t)
+	defer c.conn.Close()
+
+	if code := c.requestCode(1, "game.join", &GameJoinReq{RoomOpenHead: RoomOpenHead{RoomHead{RoomId: "r1"}}}); code != CodeOK {
+		t.Fatalf("join got %d", code)
+	}
+	c.sendMsg(MessageNotify, 0, "game.boom", &GameNotify{RoomHead{RoomId: "r1"}})
+	if code := c.requestCode(2, "game.say", &GameReq{RoomHead: RoomHead{RoomId: "r1"}}); code != CodeOK {
+		t.Fatalf("after panic got %d", code)
+	}
+}
+
+func TestRoomMembershipRace(t *testing.T) {
+	rooms := NewRoomManager(NewServer(NewRoute()))
+	sessions := NewSessionManager()
+
+	for i := 0; i < 200; i++ {
+		r, err := rooms.CreateRoom("r1", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		members := make([]*Session, 8)
+		for j := range members {
+			s := sessions.createSession()
+			members[j] = s
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 10; k++ {
+					r.Join(s)
+					runtime.Gosched()
+					r.Leave(s)
+				}
+				r.Join(s)
+			}()
+		}
+		runtime.Gosched()
+		r.Destroy()
+		wg.Wait()
+
+		for _, s := range members {
+			if n := len(rooms.RoomsOf(s)); n != 0 {
+				t.Fatalf("round %d: %d rooms left after destroy", i, n)
+			}
+		}
+	}
+}
@@ -6,29 +6,46 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 var (
-	typeOfBytes   = reflect.TypeOf(([]byte)(nil))
-	typeOfSession = reflect.TypeOf(&Session{})
+	typeOfBytes         = reflect.TypeOf(([]byte)(nil))
+	typeOfSession       = reflect.TypeOf(&Session{})
+	typeOfRequestHeader = reflect.TypeOf((*RequestHeader)(nil)).Elem()
 )
 
+// RequestNoResponseTimeout is the default of Route.NoResponseTimeout
+var RequestNoResponseTimeout = 10 * time.Second
+
 type Handler struct {
 	Receiver reflect.Value  // receiver of method
 	Method   reflect.Method // method stub
 	Type     reflect.Type   // low-level type of method
 	IsRawArg bool           // whether the data need to serialize
+	IsNotify bool           // argument does not implement RequestHeader, never responds
 }
 
 type Route struct {
-	rules map[string]*Handler
+	// NoResponseTimeout is how long a request handler could take to respond after
+	// it returned, the client gets CodeNoResponse after that. Zero or negative means
+	// no timeout, the request waits until it is responded or the session closes.
+	NoResponseTimeout time.Duration
+
+	rules     map[string]*Handler
+	responses map[string]reflect.Type // declared response types, see Schema
+	pushes    map[string]reflect.Type
+	rooms     *RoomManager // set by NewRoomManager
 }
 
 func NewRoute() *Route {
 	return &Route{
-		rules: make(map[string]*Handler),
+		NoResponseTimeout: RequestNoResponseTimeout,
+		rules:             make(map[string]*Handler),
+		responses:         make(map[string]reflect.Type),
+		pushes:            make(map[string]reflect.Type),
 	}
 }
 
@@ -78,6 +95,11 @@ func (r *Route) Reg(prefix string, service interface{}) {
 				raw = true
 			}
 
+			if !raw {
+				// panics on invalid validate tags
+				compileValidator(mt.In(2))
+			}
+
 			if prefix != "" {
 				mn = prefix + "." + mn
 			}
@@ -94,15 +116,24 @@ func (r *Route) Reg(prefix string, service interface{}) {
 				Method:   method,
 				Type:     mt.In(2),
 				IsRawArg: raw,
+				IsNotify: raw || !mt.In(2).Implements(typeOfRequestHeader),
 			}
 		}
 	}
 }
 
 func (r *Route) Exec(s *Session, msg *Message) {
+	isRequest := msg.Type == MessageRequest
+	if isRequest {
+		s.expectResponse(msg.ID)
+	}
+
 	handler, ok := r.rules[msg.Route]
 	if !ok {
 		Logger.Errorf("unhandled route %s", msg.Route)
+		if isRequest {
+			s.respondError(msg.ID, CodeNotFound, "unhandled route "+msg.Route)
+		}
 		return
 	}
 
@@ -116,14 +147,76 @@ func (r *Route) Exec(s *Session, msg *Message) {
 		err := json.Unmarshal(payload, data)
 		if err != nil {
 			Logger.Errorf("json.Unmarshal error %v %v", err, data)
+			if isRequest {
+				s.respondError(msg.ID, CodeBadRequest, "invalid payload")
+			}
 			return
 		}
 
-		if req, ok := data.(RequestHeader); ok {
+		if err := validate(data); err != nil {
+			Logger.Debugf("%v route %s %v", s, msg.Route, err)
+			if isRequest {
+				resp := &ErrorResponse{Code: CodeBadRequest, Error: "validation failed"}
+				var ve *ValidationError
+				if errors.As(err, &ve) && ve != nil {
+					resp.Fields = ve.Fields
+				}
+				s.respond(msg.ID, resp)
+			}
+			return
+		}
+
+		// notify carries no message id, so Response to it is a no-op
+		if req, ok := data.(RequestHeader); ok && isRequest {
 			req.SetMsgId(msg.ID)
 		}
 	}
 
-	args := []reflect.Value{handler.Receiver, reflect.ValueOf(s), reflect.ValueOf(data)}
-	handler.Method.Func.Call(args)
+	call := func() {
+		args := []reflect.Value{handler.Receiver, reflect.ValueOf(s), reflect.ValueOf(data)}
+		handler.Method.Func.Call(args)
+
+		if !isRequest {
+			return
+		}
+
+		if handler.IsNotify {
+			// client expects a response, ack it
+			s.respond(msg.ID, struct{}{})
+		} else {
+			s.waitResponse(msg.ID, r.NoResponseTimeout)
+		}
+	}
+
+	target, ok := data.(RoomTarget)
+	if !ok || r.rooms == nil {
+		s.execMutex.Lock()
+		defer s.execMutex.Unlock()
+		call()
+		return
+	}
+
+	// run in the room, serialized with other handlers, hooks and ticks of it
+	// instead of the session, so a session handler could wait for the room.
+	// membership is checked in the executor, after joins and leaves before it
+	open := false
+	if t, ok := data.(RoomOpenTarget); ok {
+		open = t.RoomOpen()
+	}
+	room := r.rooms.GetRoom(target.GetRoomId())
+	if room == nil || room.Post(func() {
+		if !open && !room.IsMember(s) {
+			Logger.Debugf("%v route %s not a member of %v", s, msg.Route, room)
+			if isRequest {
+				s.respondError(msg.ID, CodeForbidden, "not a member of room")
+			}
+			return
+		}
+		call()
+	}) != nil {
+		Logger.Debugf("%v route %s room %s not found", s, msg.Route, target.GetRoomId())
+		if isRequest {
+			s.respondError(msg.ID, CodeNotFound, "room not found")
+		}
+	}
 }
@@ -0,0 +1,178 @@
+package kit
+
+import (
+	"sync"
+	"time"
+)
+
+// Task is a scheduled callback returned by After and Every, tasks of a session or
+// room are stopped when it is closed
+type Task struct {
+	mutex    sync.Mutex
+	timer    *time.Timer
+	interval time.Duration // zero runs once
+	next     time.Time
+	run      func() bool // runs the callback in the owner context, false if the owner is gone
+	owner    *taskSet
+	stopped  bool
+}
+
+func newTask(owner *taskSet, d, interval time.Duration, run func() bool) *Task {
+	t := &Task{
+		interval: interval,
+		next:     time.Now().Add(d),
+		run:      run,
+		owner:    owner,
+	}
+
+	// hold the lock so fire never sees a nil timer
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if owner != nil && !owner.add(t) {
+		t.stopped = true
+		return t
+	}
+	t.timer = time.AfterFunc(d, t.fire)
+	return t
+}
+
+func (t *Task) fire() {
+	t.mutex.Lock()
+	stopped := t.stopped
+	t.mutex.Unlock()
+
+	if stopped {
+		return
+	}
+
+	if !t.run() || t.interval <= 0 {
+		t.Stop()
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.stopped {
+		return
+	}
+
+	// fixed rate, ticks missed by a slow callback are skipped
+	now := time.Now()
+	t.next = t.next.Add(t.interval)
+	for !t.next.After(now) {
+		t.next = t.next.Add(t.interval)
+	}
+	t.timer.Reset(t.next.Sub(now))
+}
+
+// Stop cancels the task, a running callback is not interrupted
+func (t *Task) Stop() {
+	t.mutex.Lock()
+	if t.stopped {
+		t.mutex.Unlock()
+		return
+	}
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.mutex.Unlock()
+
+	if t.owner != nil {
+		t.owner.remove(t)
+	}
+}
+
+// taskSet keeps tasks of an owner to stop them on close
+type taskSet struct {
+	mutex  sync.Mutex
+	tasks  map[*Task]bool
+	closed bool
+}
+
+func (s *taskSet) add(t *Task) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.tasks == nil {
+		s.tasks = make(map[*Task]bool)
+	}
+	s.tasks[t] = true
+	return true
+}
+
+func (s *taskSet) remove(t *Task) {
+	s.mutex.Lock()
+	delete(s.tasks, t)
+	s.mutex.Unlock()
+}
+
+// stopAll stops all tasks and rejects new ones
+func (s *taskSet) stopAll() {
+	s.mutex.Lock()
+	s.closed = true
+	tasks := s.tasks
+	s.tasks = nil
+	s.mutex.Unlock()
+
+	for t := range tasks {
+		t.Stop()
+	}
+}
+
+// Every calls fn at a fixed rate in its own goroutine until the task is stopped
+func (s *Server) Every(interval time.Duration, fn func()) *Task {
+	return newTask(nil, interval, interval, func() bool {
+		fn()
+		return true
+	})
+}
+
+// After calls fn after d, serialized with handlers of the session. It is
+// cancelled if the session is closed.
+func (s *Session) After(d time.Duration, fn func()) *Task {
+	return newTask(&s.tasks, d, 0, s.execFunc(fn))
+}
+
+// Every calls fn at a fixed rate, serialized with handlers of the session, until
+// the task is stopped or the session is closed
+func (s *Session) Every(interval time.Duration, fn func()) *Task {
+	return newTask(&s.tasks, interval, interval, s.execFunc(fn))
+}
+
+func (s *Session) execFunc(fn func()) func() bool {
+	return func() bool {
+		s.execMutex.Lock()
+		defer s.execMutex.Unlock()
+
+		if s.isClosed() {
+			return false
+		}
+		fn()
+		return true
+	}
+}
+
+// After calls fn after d in the executor of the room. It is cancelled if the
+// room is destroyed.
+func (r *Room) After(d time.Duration, fn func()) *Task {
+	return newTask(&r.tasks, d, 0, r.execFunc(fn))
+}
+
+// Every calls fn at a fixed rate in the executor of the room, e.g. the game loop,
+// until the task is stopped or the room is destroyed
+func (r *Room) Every(interval time.Duration, fn func()) *Task {
+	return newTask(&r.tasks, interval, interval, r.execFunc(fn))
+}
+
+func (r *Room) execFunc(fn func()) func() bool {
+	return func() bool {
+		// wait for it, so a slow tick delays the next one instead of piling up
+		return r.Do(fn) == nil
+	}
+}
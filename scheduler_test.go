@@ -0,0 +1,156 @@
+package kit
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Sched struct {
+	session  chan *Session
+	inside   int32
+	ticks    int32
+	overlaps int32
+}
+
+type SchedReq struct {
+	RequestHead
+}
+
+func (h *Sched) Start(s *Session, r *SchedReq) {
+	s.Every(2*time.Millisecond, func() {
+		if atomic.LoadInt32(&h.inside) != 0 {
+			atomic.AddInt32(&h.overlaps, 1)
+		}
+		atomic.AddInt32(&h.ticks, 1)
+	})
+	h.session <- s
+	s.Response(r, struct{}{})
+}
+
+func (h *Sched) Slow(s *Session, r *SchedReq) {
+	atomic.StoreInt32(&h.inside, 1)
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt32(&h.inside, 0)
+	s.Response(r, struct{}{})
+}
+
+func newSchedClient(t *testing.T) (*testClient, *Sched, *Session) {
+	h := &Sched{session: make(chan *Session, 1)}
+	route := NewRoute()
+	route.Reg("sched", h)
+	c := dialTest(t, NewServer(route), nil, true)
+	if code := c.requestCode(1, "sched.start", &SchedReq{}); code != CodeOK {
+		t.Fatalf("start got %d", code)
+	}
+	return c, h, <-h.session
+}
+
+func TestSessionTasksSerialized(t *testing.T) {
+	c, h, _ := newSchedClient(t)
+	defer c.conn.Close()
+
+	for i := uint(2); i < 7; i++ {
+		if code := c.requestCode(i, "sched.slow", &SchedReq{}); code != CodeOK {
+			t.Fatalf("slow got %d", code)
+		}
+	}
+	if atomic.LoadInt32(&h.ticks) == 0 {
+		t.Fatal("task never ran")
+	}
+	if n := atomic.LoadInt32(&h.overlaps); n > 0 {
+		t.Fatalf("task ran %d times inside a handler", n)
+	}
+}
+
+func TestSessionTasksStopOnClose(t *testing.T) {
+	c, h, s := newSchedClient(t)
+	defer c.conn.Close()
+
+	var later int32
+	s.After(time.Hour, func() { atomic.AddInt32(&later, 1) })
+	waitUntil(t, func() bool { return atomic.LoadInt32(&h.ticks) > 0 })
+	s.Close("bye")
+
+	s.tasks.mutex.Lock()
+	n := len(s.tasks.tasks)
+	s.tasks.mutex.Unlock()
+	if n != 0 {
+		t.Fatalf("%d tasks left after close", n)
+	}
+
+	ticks := atomic.LoadInt32(&h.ticks)
+	task := s.After(0, func() { atomic.AddInt32(&later, 1) })
+	time.Sleep(20 * time.Millisecond)
+	if !task.stopped {
+		t.Fatal("task accepted after close")
+	}
+	if atomic.LoadInt32(&h.ticks) != ticks || atomic.LoadInt32(&later) != 0 {
+		t.Fatal("task ran after close")
+	}
+}
+
+func TestRoomTasksStopOnDestroy(t *testing.T) {
+	rooms := NewRoomManager(NewServer(NewRoute()))
+	destroyed := make(chan struct{})
+	room, err := rooms.CreateRoom("r1", 0, &RoomHooks{
+		OnDestroy: func(r *Room) { close(destroyed) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ticks int32
+	room.Every(2*time.Millisecond, func() { atomic.AddInt32(&ticks, 1) })
+	waitUntil(t, func() bool { return atomic.LoadInt32(&ticks) > 0 })
+	room.Destroy()
+
+	// a tick posted before Destroy may still run before OnDestroy
+	<-destroyed
+	n := atomic.LoadInt32(&ticks)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&ticks) != n {
+		t.Fatal("task ran after destroy")
+	}
+	if task := room.After(0, func() {}); !task.stopped {
+		t.Fatal("task accepted after destroy")
+	}
+}
+
+func TestEverySkipsMissedTicks(t *testing.T) {
+	interval := 50 * time.Millisecond
+	type tick struct{ at, scheduled time.Time }
+	ticks := make(chan tick, 2)
+
+	// the callback gets the task through it, it is assigned after Every returns
+	self := make(chan *Task, 1)
+	runs := 0
+	self <- NewServer(NewRoute()).Every(interval, func() {
+		task := <-self
+		defer func() { self <- task }()
+
+		task.mutex.Lock()
+		scheduled := task.next
+		task.mutex.Unlock()
+
+		ticks <- tick{time.Now(), scheduled}
+		if runs++; runs == 1 {
+			// miss the next two ticks
+			time.Sleep(interval*2 + interval/2)
+		} else {
+			task.Stop()
+		}
+	})
+
+	first, second := <-ticks, <-ticks
+	gap := second.scheduled.Sub(first.scheduled)
+	if gap < 3*interval || gap%interval != 0 {
+		t.Fatalf("next tick scheduled %v after the slow one", gap)
+	}
+	if second.at.Before(second.scheduled) {
+		t.Fatal("tick ran before it was scheduled")
+	}
+	if second.at.Sub(first.at) < 5*interval/2 {
+		t.Fatal("missed ticks were run at once")
+	}
+}
@@ -0,0 +1,270 @@
+package kit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	typeOfTime       = reflect.TypeOf(time.Time{})
+	typeOfRawMessage = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// Kinds of TypeSchema
+const (
+	SchemaKindAny     = "any"
+	SchemaKindString  = "string"
+	SchemaKindNumber  = "number"
+	SchemaKindBoolean = "boolean"
+	SchemaKindBytes   = "bytes" // base64 string in json
+	SchemaKindArray   = "array"
+	SchemaKindMap     = "map"
+	SchemaKindObject  = "object"
+	SchemaKindRef     = "ref" // reference to Schema.Types
+)
+
+// TypeSchema describes the json shape of a go type
+type TypeSchema struct {
+	Kind     string         `json:"kind"`
+	Ref      string         `json:"ref,omitempty"`
+	Nullable bool           `json:"nullable,omitempty"`
+	Elem     *TypeSchema    `json:"elem,omitempty"`
+	Fields   []*FieldSchema `json:"fields,omitempty"`
+}
+
+type FieldSchema struct {
+	Name     string      `json:"name"`
+	Optional bool        `json:"optional,omitempty"`
+	Type     *TypeSchema `json:"type"`
+}
+
+type RouteSchema struct {
+	Route    string      `json:"route"`
+	Notify   bool        `json:"notify"`
+	Request  *TypeSchema `json:"request"`
+	Response *TypeSchema `json:"response,omitempty"`
+}
+
+type PushSchema struct {
+	Route string      `json:"route"`
+	Data  *TypeSchema `json:"data"`
+}
+
+// Schema lists every route registered in a Route with their payload types
+type Schema struct {
+	Routes []*RouteSchema         `json:"routes"`
+	Pushes []*PushSchema          `json:"pushes"`
+	Types  map[string]*TypeSchema `json:"types"`
+}
+
+// DeclareResponse records the response type of a registered request route, it is
+// only used by Schema
+func (r *Route) DeclareResponse(route string, v interface{}) {
+	route = strings.ToLower(route)
+	if _, ok := r.rules[route]; !ok {
+		panic(fmt.Errorf("route rule with name %s not found", route))
+	}
+	r.responses[route] = reflect.TypeOf(v)
+}
+
+// DeclarePush records the data type pushed by Session.Push with the route
+func (r *Route) DeclarePush(route string, v interface{}) {
+	if _, ok := r.pushes[route]; ok {
+		panic(fmt.Errorf("push route with name %s already existed", route))
+	}
+	r.pushes[route] = reflect.TypeOf(v)
+}
+
+// Schema walks all registered routes
+func (r *Route) Schema() *Schema {
+	b := &schemaBuilder{
+		schema: &Schema{
+			Routes: make([]*RouteSchema, 0, len(r.rules)),
+			Pushes: make([]*PushSchema, 0, len(r.pushes)),
+			Types:  make(map[string]*TypeSchema),
+		},
+		names: make(map[reflect.Type]string),
+	}
+
+	// walk in order so that renamed types are stable between runs
+	names := make([]string, 0, len(r.rules))
+	for name := range r.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		handler := r.rules[name]
+		rs := &RouteSchema{
+			Route:  name,
+			Notify: handler.IsNotify,
+		}
+		if handler.IsRawArg {
+			// raw handlers get the json bytes as sent, not a base64 string
+			rs.Request = &TypeSchema{Kind: SchemaKindAny}
+		} else {
+			rs.Request = b.rootSchema(handler.Type)
+		}
+		if t, ok := r.responses[name]; ok {
+			rs.Response = b.rootSchema(t)
+		}
+		b.schema.Routes = append(b.schema.Routes, rs)
+	}
+
+	names = names[:0]
+	for name := range r.pushes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.schema.Pushes = append(b.schema.Pushes, &PushSchema{
+			Route: name,
+			Data:  b.rootSchema(r.pushes[name]),
+		})
+	}
+	return b.schema
+}
+
+// ExportSchema writes Schema as json, the output is the input of cmd/kitgen
+func (r *Route) ExportSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Schema())
+}
+
+type schemaBuilder struct {
+	schema *Schema
+	names  map[reflect.Type]string
+}
+
+func (b *schemaBuilder) typeName(t reflect.Type) string {
+	if name, ok := b.names[t]; ok {
+		return name
+	}
+
+	name := t.Name()
+	if _, ok := b.schema.Types[name]; ok {
+		// same name in different packages
+		name = path.Base(t.PkgPath()) + "_" + name
+	}
+	base := name
+	for i := 2; ; i++ {
+		if _, ok := b.schema.Types[name]; !ok {
+			break
+		}
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+
+	b.names[t] = name
+	return name
+}
+
+// rootSchema ignores the pointer of payloads, they are never null
+func (b *schemaBuilder) rootSchema(t reflect.Type) *TypeSchema {
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return b.typeSchema(t)
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) *TypeSchema {
+	if t == nil {
+		return &TypeSchema{Kind: SchemaKindAny}
+	}
+
+	switch t {
+	case typeOfBytes:
+		return &TypeSchema{Kind: SchemaKindBytes}
+	case typeOfRawMessage:
+		return &TypeSchema{Kind: SchemaKindAny}
+	case typeOfTime:
+		return &TypeSchema{Kind: SchemaKindString}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.typeSchema(t.Elem())
+		c := *s
+		c.Nullable = true
+		return &c
+	case reflect.String:
+		return &TypeSchema{Kind: SchemaKindString}
+	case reflect.Bool:
+		return &TypeSchema{Kind: SchemaKindBoolean}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return &TypeSchema{Kind: SchemaKindNumber}
+	case reflect.Slice, reflect.Array:
+		return &TypeSchema{Kind: SchemaKindArray, Elem: b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return &TypeSchema{Kind: SchemaKindMap, Elem: b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return &TypeSchema{Kind: SchemaKindObject, Fields: b.fields(t)}
+		}
+
+		if name, ok := b.names[t]; ok {
+			return &TypeSchema{Kind: SchemaKindRef, Ref: name}
+		}
+
+		name := b.typeName(t)
+		// register before walking fields for recursive types
+		obj := &TypeSchema{Kind: SchemaKindObject}
+		b.schema.Types[name] = obj
+		obj.Fields = b.fields(t)
+		return &TypeSchema{Kind: SchemaKindRef, Ref: name}
+	}
+
+	return &TypeSchema{Kind: SchemaKindAny}
+}
+
+// fields follows the field naming rules of encoding/json
+func (b *schemaBuilder) fields(t reflect.Type) []*FieldSchema {
+	fields := make([]*FieldSchema, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, b.fields(ft)...)
+				continue
+			}
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, &FieldSchema{
+			Name:     name,
+			Optional: strings.Contains(opts, "omitempty"),
+			Type:     b.typeSchema(f.Type),
+		})
+	}
+	return fields
+}
@@ -0,0 +1,94 @@
+package kit
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// SchemaNode is recursive
+type SchemaNode struct {
+	Name     string        `json:"name"`
+	Parent   *SchemaNode   `json:"parent"`
+	Children []*SchemaNode `json:"children,omitempty"`
+}
+
+// Point collides with image.Point
+type Point struct {
+	X float64 `json:"x"`
+}
+
+type SchemaMeta struct {
+	Trace string `json:"trace"`
+}
+
+type SchemaDrawReq struct {
+	RequestHead
+	SchemaMeta
+	Origin Point          `json:"origin"`
+	Pixel  image.Point    `json:"pixel"`
+	Root   *SchemaNode    `json:"root"`
+	Note   string         `json:"note,omitempty"`
+	Tags   map[string]int `json:"tags"`
+	At     time.Time      `json:"at"`
+	Image  []byte         `json:"image"`
+	Secret string         `json:"-"`
+	hidden int
+}
+
+type SchemaPing struct {
+	At int64 `json:"at"`
+}
+
+type SchemaHandler struct{}
+
+func (h *SchemaHandler) Draw(s *Session, r *SchemaDrawReq) {}
+
+func (h *SchemaHandler) Ping(s *Session, r *SchemaPing) {}
+
+func (h *SchemaHandler) Raw(s *Session, data []byte) {}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatched, run go test -update after checking:\n%s", file, got)
+	}
+}
+
+func TestSchemaGolden(t *testing.T) {
+	route := NewRoute()
+	route.Reg("schema", &SchemaHandler{})
+	route.DeclareResponse("schema.draw", &SchemaNode{})
+	route.DeclarePush("schema.moved", &Point{})
+	route.DeclarePush("schema.pixel", image.Point{})
+
+	buf := &bytes.Buffer{}
+	if err := route.ExportSchema(buf); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "schema.json", buf.Bytes())
+
+	buf.Reset()
+	if err := WriteTypeScript(buf, route.Schema()); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "schema.ts", buf.Bytes())
+}
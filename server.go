@@ -1,17 +1,70 @@
 package kit
 
 import (
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+var (
+	ErrTooManyConnections      = errors.New("too many connections")
+	ErrTooManyConnectionsPerIP = errors.New("too many connections from the same ip")
+)
+
 type Server struct {
-	HeartbeatInterval time.Duration
-	SessionManager    *SessionManager
-	Route             *Route
+	HeartbeatInterval   time.Duration
+	HandshakeTimeout    time.Duration // close connections not finishing handshake in time, zero disables it
+	MaxConnections      int           // zero means unlimited
+	MaxConnectionsPerIP int           // zero means unlimited
+	WriteQueueSize      int           // zero means KitConnWriteQueueSize
+	SlowConsumerPolicy  SlowConsumerPolicy
+	WriteBlockTimeout   time.Duration // used by SlowConsumerBlock
+	WriteTimeout        time.Duration // write deadline of the socket, zero disables it
+	Compression         WebSocketCompression
+	Subprotocols        []string // accepted websocket subprotocols in preference order
+	MinProtocolVersion  int      // reject handshakes of older clients, zero means 1
+	Capabilities        []string // capabilities offered in the handshake
+	// EncryptionKey signs the key exchange of CapabilityEncryption, clients pin
+	// its public key, see EncryptionPublicKey. Handshakes asking for encryption
+	// are rejected without it.
+	EncryptionKey *ecdsa.PrivateKey
+	// RequireEncryption rejects handshakes without CapabilityEncryption, which
+	// must be in Capabilities, and SSE, which has no handshake
+	RequireEncryption bool
+	// ResumeSecret signs resume tokens, it is random by default so tokens are
+	// invalid after restart, set the same secret on servers sharing a SessionStore
+	ResumeSecret   []byte
+	ResumeTokenTTL time.Duration
+	// ResumeGrace keeps the previous resume token valid after resuming until the
+	// new one is used, for clients which did not get the new one
+	ResumeGrace time.Duration
+	// Admission could reject a connection before upgrading by returning an error
+	Admission      func(r *http.Request) error
+	SessionManager *SessionManager
+	Route          *Route
+	rateLimiter    *rateLimiter
+	connMutex      sync.Mutex
+	connCount      int
+	ipConnCount    map[string]int
+	pollMutex      sync.Mutex
+	pollConns      map[string]*pollConn
+	upgraderOnce   sync.Once
+	upgrader       *websocket.Upgrader
+	upgraderErr    error
+}
+
+// WebSocketCompression configures permessage-deflate
+type WebSocketCompression struct {
+	Enabled   bool
+	Level     int // flate level from -2 to 9, zero means default
+	Threshold int // messages shorter than Threshold bytes are sent uncompressed
 }
 
 func NewServer(route *Route) *Server {
@@ -19,40 +72,163 @@ func NewServer(route *Route) *Server {
 		SessionManager:    NewSessionManager(),
 		Route:             route,
 		HeartbeatInterval: 5 * time.Second,
+		HandshakeTimeout:  10 * time.Second,
+		ResumeSecret:      newResumeSecret(),
+		ResumeTokenTTL:    24 * time.Hour,
+		ResumeGrace:       10 * time.Second,
+		WriteBlockTimeout: time.Second,
+		WriteTimeout:      10 * time.Second,
+		ipConnCount:       make(map[string]int),
+		pollConns:         make(map[string]*pollConn),
+		Subprotocols:      []string{SubprotocolBinary, SubprotocolJSON},
 	}
 
 	go server.SessionManager.CheckExpire()
 	return server
 }
 
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admit checks the connection limits and Admission, release must be called when
+// the connection is gone
+func (s *Server) admit(r *http.Request) (release func(), code int, err error) {
+	if s.Admission != nil {
+		if err := s.Admission(r); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+	}
+
+	ip := remoteIP(r)
+
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.MaxConnections > 0 && s.connCount >= s.MaxConnections {
+		return nil, http.StatusServiceUnavailable, ErrTooManyConnections
+	}
+
+	if s.MaxConnectionsPerIP > 0 && s.ipConnCount[ip] >= s.MaxConnectionsPerIP {
+		return nil, http.StatusTooManyRequests, ErrTooManyConnectionsPerIP
+	}
+
+	s.connCount++
+	s.ipConnCount[ip]++
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			s.connMutex.Lock()
+			s.connCount--
+			if s.ipConnCount[ip]--; s.ipConnCount[ip] <= 0 {
+				delete(s.ipConnCount, ip)
+			}
+			s.connMutex.Unlock()
+		})
+	}
+	return release, http.StatusOK, nil
+}
+
+// ConnectionCount returns the number of admitted connections
+func (s *Server) ConnectionCount() int {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.connCount
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(_ *http.Request) bool { return true },
+	release, code, err := s.admit(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		Logger.Warnf("connection from %s rejected: %v", r.RemoteAddr, err)
+		return
 	}
+	defer release()
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	upgrader, err := s.getUpgrader()
 	if err != nil {
 		http.Error(w, err.Error(), 500)
-		Logger.Errorf("websocket upgrade failure, URI=%s, Error=%v", r.RequestURI, err)
+		Logger.Errorf("websocket upgrader error %v", err)
 		return
 	}
 
-	c, err := newWSConn(conn)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
-		Logger.Errorf("newWSConn error %v", err)
+		Logger.Errorf("websocket upgrade failure, URI=%s, Error=%v", r.RequestURI, err)
 		return
 	}
 
+	// clients without subprotocol could still select json text frames by ?format=json
+	protocol := defaultWireProtocol
+	if name := conn.Subprotocol(); name != "" {
+		protocol, _ = ParseSubprotocol(name)
+	} else if r.URL.Query().Get("format") == "json" {
+		protocol.Codec = CodecJSON
+	}
+
+	if s.Compression.Enabled && s.Compression.Level != 0 {
+		if err := conn.SetCompressionLevel(s.Compression.Level); err != nil {
+			Logger.Errorf("websocket SetCompressionLevel error %v", err)
+		}
+	}
+
+	c := newWSConn(conn, protocol.Codec == CodecJSON)
+	if s.Compression.Enabled {
+		c.compressThreshold = s.Compression.Threshold
+	}
+
 	kitConn := NewKitConn(s, c)
+	kitConn.Identity = peerIdentityFromTLS(r.TLS)
+	kitConn.Protocol = protocol
 	kitConn.Handle()
 }
 
-func (s *Server) RunWebSocketServer(path string, port int) {
+// getUpgrader builds the websocket.Upgrader on first use, so Compression and
+// Subprotocols must be set before serving. An invalid subprotocol fails every
+// upgrade.
+func (s *Server) getUpgrader() (*websocket.Upgrader, error) {
+	s.upgraderOnce.Do(func() {
+		for _, name := range s.Subprotocols {
+			if _, err := ParseSubprotocol(name); err != nil {
+				s.upgraderErr = err
+				return
+			}
+		}
+
+		s.upgrader = &websocket.Upgrader{
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			CheckOrigin:       func(_ *http.Request) bool { return true },
+			Subprotocols:      s.Subprotocols,
+			EnableCompression: s.Compression.Enabled,
+		}
+	})
+	return s.upgrader, s.upgraderErr
+}
+
+// newServeMux serves websocket at path, the long poll fallback at path/poll and
+// server-sent events at path/sse
+func (s *Server) newServeMux(path string) *http.ServeMux {
+	// fail before listening rather than on every connection
+	if _, err := s.getUpgrader(); err != nil {
+		panic(err)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc(path, s.ServeHTTP)
+	mux.HandleFunc(strings.TrimSuffix(path, "/")+"/poll", s.ServeLongPoll)
+	mux.HandleFunc(strings.TrimSuffix(path, "/")+"/sse", s.ServeSSE)
+	return mux
+}
+
+func (s *Server) RunWebSocketServer(path string, port int) {
+	mux := s.newServeMux(path)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -0,0 +1,106 @@
+package kit
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestInvalidSubprotocolFailsUpgrades(t *testing.T) {
+	server := NewServer(NewRoute())
+	server.Subprotocols = []string{"not-kit"}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("upgrade %d returned %d", i, w.Code)
+		}
+	}
+}
+
+func dialWS(t *testing.T, url string, header http.Header) (*websocket.Conn, int) {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), header)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+	return conn, resp.StatusCode
+}
+
+func TestAdmission(t *testing.T) {
+	server := NewServer(NewRoute())
+	server.Admission = func(r *http.Request) error {
+		if r.Header.Get("X-Banned") != "" {
+			return errors.New("banned")
+		}
+		return nil
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	if _, code := dialWS(t, ts.URL, http.Header{"X-Banned": {"1"}}); code != http.StatusForbidden {
+		t.Fatalf("rejected connection returned %d", code)
+	}
+	conn, code := dialWS(t, ts.URL, nil)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("admitted connection returned %d", code)
+	}
+	conn.Close()
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	server := NewServer(NewRoute())
+	server.MaxConnectionsPerIP = 1
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	first, _ := dialWS(t, ts.URL, nil)
+	if _, code := dialWS(t, ts.URL, nil); code != http.StatusTooManyRequests {
+		t.Fatalf("second connection returned %d", code)
+	}
+
+	first.Close()
+	waitUntil(t, func() bool { return server.ConnectionCount() == 0 })
+	conn, code := dialWS(t, ts.URL, nil)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("connection after the first closed returned %d", code)
+	}
+	conn.Close()
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := NewServer(NewRoute())
+	server.HandshakeTimeout = 20 * time.Millisecond
+	server.HeartbeatInterval = 50 * time.Millisecond
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, _ := dialWS(t, ts.URL, nil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("connection without handshake not closed")
+			}
+			break
+		}
+	}
+	waitUntil(t, func() bool { return server.ConnectionCount() == 0 })
+
+	// finishing the handshake in time keeps it open
+	c := dialTest(t, server, nil, true)
+	defer c.conn.Close()
+	time.Sleep(2 * server.HandshakeTimeout)
+	c.read(PacketHeartbeat)
+}
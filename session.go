@@ -1,6 +1,9 @@
 package kit
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -15,6 +18,19 @@ const (
 
 var SessionMaxDelayMsgCount = 100 // 必须比 KitConnWriteQueueSize 小
 
+// SessionSaveDelay is the default of SessionManager.SaveDelay
+var SessionSaveDelay = time.Second
+
+// SessionRequestTimeout is used by Session.Request when ctx has no deadline
+var SessionRequestTimeout = 10 * time.Second
+
+const httpReqIdBase = 1 << 30
+
+var (
+	ErrSessionClosed    = errors.New("session closed")
+	ErrNotifyNoResponse = errors.New("notify message has no response")
+)
+
 type SessionCloseEventListener interface {
 	OnSessionClose(s *Session)
 }
@@ -26,116 +42,524 @@ type Session struct {
 	LostConnection time.Time
 	status         int
 	conn           *KitConn
+	attaching      *KitConn // set by setConn while flushing delayMsgs
 	data           map[string]interface{}
 	delayMsgs      []*Message
+	reqMutex       sync.Mutex
+	reqId          uint
+	pending        map[uint]chan *Message
+	inflight       map[uint]*time.Timer // requests from client waiting for response
+	httpReqId      uint
+	captures       map[uint]chan *Message // responses of http requests, see ServeSSE
+	limiter        *sessionLimiter
+	identity       *PeerIdentity
+	certHash       []byte     // fingerprint of identity, kept by snapshots
+	resumeNonce    []byte     // embedded in the current resume token
+	execMutex      sync.Mutex // serializes handlers and scheduled callbacks
+	tasks          taskSet
+	expireAt       time.Time   // guarded by Manager.expiry
+	expireIndex    int         // in Manager.expiry, -1 if not scheduled
+	saveMutex      sync.Mutex  // keeps snapshots written in order
+	saveTimer      *time.Timer // pending save of delayMsgs
+	version        uint64      // of the last snapshot
+
+	// the resume nonce before resumeNonce, accepted until prevResumeExpire
+	prevResumeNonce  []byte
+	prevResumeExpire time.Time
 }
 
 func newSession(m *SessionManager) *Session {
 	return &Session{
-		Manager: m,
-		Id:      uuid.New().String(),
-		status:  SessionStatusNormal,
-		data:    make(map[string]interface{}),
+		Manager:     m,
+		Id:          uuid.New().String(),
+		status:      SessionStatusNormal,
+		data:        make(map[string]interface{}),
+		pending:     make(map[uint]chan *Message),
+		inflight:    make(map[uint]*time.Timer),
+		captures:    make(map[uint]chan *Message),
+		expireIndex: -1,
 	}
 }
 
 func (s *Session) String() string {
-	return fmt.Sprintf("Session(%s, conn=%v)", s.Id[0:8], s.conn)
+	return fmt.Sprintf("Session(%s)", s.Id[0:8])
+}
+
+func (s *Session) isClosed() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.status == SessionStatusClosed
 }
 
 func (s *Session) Close(reason string) {
-	if s.status == SessionStatusClosed {
+	s.close(reason, nil)
+}
+
+// close closes the session if it is not closed and check returns true, check is
+// called with lock held
+func (s *Session) close(reason string, check func() bool) {
+	s.Lock()
+	if s.status == SessionStatusClosed || (check != nil && !check()) {
+		s.Unlock()
 		return
 	}
 	s.status = SessionStatusClosed
+	s.Manager.expiry.cancel(s)
+	conn := s.conn
+	if conn == nil {
+		conn = s.attaching
+	}
+	s.conn = nil
+	s.attaching = nil
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+	listeners := make([]SessionCloseEventListener, 0)
+	for _, v := range s.data {
+		if h, ok := v.(SessionCloseEventListener); ok {
+			listeners = append(listeners, h)
+		}
+	}
+	s.Unlock()
 
 	Logger.Debugf("%v closed for reason %s", s, reason)
 
-	if s.conn != nil {
-		s.conn.Session = nil
-		s.conn.Close("session closed") // force close
-		s.conn = nil
+	if conn != nil {
+		conn.Close("session closed") // force close
 	}
 
-	for _, v := range s.data {
-		if h, ok := v.(SessionCloseEventListener); ok {
-			h.OnSessionClose(s)
-		}
+	for _, h := range listeners {
+		h.OnSessionClose(s)
 	}
+	s.Manager.fireSessionClosed(s, reason)
+	s.tasks.stopAll()
+
+	s.Lock()
 	s.data = nil
+	s.delayMsgs = nil
+	s.Unlock()
+
+	// wake up all goroutines waiting in Request
+	s.reqMutex.Lock()
+	for id, ch := range s.pending {
+		close(ch)
+		delete(s.pending, id)
+	}
+	for id, t := range s.inflight {
+		if t != nil {
+			t.Stop()
+		}
+		delete(s.inflight, id)
+	}
+	for id, ch := range s.captures {
+		close(ch)
+		delete(s.captures, id)
+	}
+	s.reqMutex.Unlock()
 
 	s.Manager.removeSession(s)
-	s.Manager = nil
+}
+
+// PeerIdentity returns the verified client certificate the session is bound to,
+// nil for a session restored from SessionStore until a connection is attached
+func (s *Session) PeerIdentity() *PeerIdentity {
+	s.RLock()
+	defer s.RUnlock()
+	return s.identity
+}
+
+// acceptsIdentity reports whether a client of identity may resume the session,
+// sessions not bound to a certificate accept anyone
+func (s *Session) acceptsIdentity(identity *PeerIdentity) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.identity != nil {
+		return s.identity.equal(identity)
+	}
+	return s.certHash == nil || identity.matchFingerprint(s.certHash)
 }
 
 func (s *Session) getConn() *KitConn {
+	s.RLock()
+	defer s.RUnlock()
 	return s.conn
 }
 
+// closeExpired closes the session if it is still not resumed SessionExpireTimeout
+// after losing connection
+func (s *Session) closeExpired(now time.Time) {
+	s.close("lose connection and expired", func() bool {
+		return !s.LostConnection.IsZero() && !s.LostConnection.Add(SessionExpireTimeout).After(now)
+	})
+}
+
+// lose marks the session disconnected and schedules closing it, it must be called
+// with lock held
+func (s *Session) lose(t time.Time) {
+	s.LostConnection = t
+	s.Manager.expiry.schedule(s, t.Add(SessionExpireTimeout))
+}
+
 func (s *Session) setConn(conn *KitConn) {
+	s.Lock()
 	if s.status != SessionStatusNormal {
-		Logger.Warnf("%v.SetConn(%v) status != Normal return", s, conn)
+		s.Unlock()
+		// closed between handshake and ack
+		Logger.Debugf("%v.SetConn(%v) status != Normal return", s, conn)
+		conn.Close("session closed")
 		return
 	}
 
-	if s.conn == conn {
+	if s.conn == conn || s.attaching == conn {
+		s.Unlock()
 		Logger.Warnf("%v.SetConn(%v) old == new return", s, conn)
 		return
 	}
 
-	if s.conn != nil {
-		s.conn.Session = nil
-		s.conn.Close("replaced by new connection")
+	// the session was used by another connection
+	resumed := s.conn != nil || s.attaching != nil || !s.LostConnection.IsZero()
+
+	// detached while flushing delayMsgs, so Write keeps queuing in order, a zero
+	// LostConnection keeps it from expiring meanwhile
+	old := s.conn
+	if old == nil {
+		old = s.attaching
+	}
+	s.conn = nil
+	s.attaching = conn
+	s.LostConnection = time.Time{}
+	s.Manager.expiry.cancel(s)
+	if conn.Identity != nil {
+		s.identity = conn.Identity
+		s.certHash = conn.Identity.Fingerprint()
 	}
+	s.Unlock()
 
-	Logger.Debugf("%v.SetConn(%v)", s, conn)
+	if old != nil {
+		old.Close("replaced by new connection")
+	}
 
-	s.conn = conn
-	s.LostConnection = time.Time{}
+	Logger.Debugf("%v.SetConn(%v)", s, conn)
 
-	if len(s.delayMsgs) > 0 {
-		Logger.Debugf("%v write delayMsgs %d", s, len(s.delayMsgs))
-		for _, msg := range s.delayMsgs {
-			s.conn.WriteMsg(msg)
-		}
+	for {
+		s.Lock()
+		msgs := s.delayMsgs
 		s.delayMsgs = nil
+		if len(msgs) == 0 {
+			if s.status != SessionStatusNormal || s.attaching != conn {
+				// closed or replaced by another connection meanwhile
+				s.Unlock()
+				return
+			}
+			s.attaching = nil
+			if conn.isClosed() {
+				// lost before attached, KitConn.Close skipped lostConn
+				s.lose(time.Now())
+				s.Unlock()
+				Logger.Debugf("%v.SetConn(%v) closed while attaching", s, conn)
+				s.save()
+				return
+			}
+			s.conn = conn
+			s.Unlock()
+			break
+		}
+		s.Unlock()
+
+		Logger.Debugf("%v write delayMsgs %d", s, len(msgs))
+		// high priority messages first, the writer may start before all are queued
+		for p := priorityCount - 1; p >= 0; p-- {
+			for _, msg := range msgs {
+				if msg.Priority == p {
+					conn.WriteMsg(msg)
+				}
+			}
+		}
 	}
+
+	s.Manager.fireConnAttached(s, conn, resumed)
 }
 
-func (s *Session) lostConn() {
-	if s.conn != nil {
-		s.conn.Session = nil
-		s.conn = nil
-		s.LostConnection = time.Now()
-		Logger.Debugf("%v.LostConn()", s)
+// lostConn is called by conn when it is closed
+func (s *Session) lostConn(conn *KitConn) {
+	s.Lock()
+	if s.status != SessionStatusNormal {
+		s.Unlock()
+		return
 	}
+	if s.conn != conn {
+		// created for conn at handshake but never attached, it would stay in
+		// the pool forever unless it expires like a lost one
+		fresh := s.conn == nil && s.attaching == nil && s.LostConnection.IsZero()
+		if fresh {
+			s.lose(time.Now())
+		}
+		s.Unlock()
+		if fresh {
+			Logger.Debugf("%v.LostConn(%v) before attached", s, conn)
+			s.save()
+		}
+		return
+	}
+	s.conn = nil
+	s.lose(time.Now())
+	s.Unlock()
+
+	Logger.Debugf("%v.LostConn()", s)
+	s.save()
+	s.Manager.fireConnLost(s)
 }
 
 func (s *Session) Push(route string, v interface{}) error {
 	return s.Write(MessagePush, 0, route, v)
 }
 
+// Response replies to a request, responding to a notify returns ErrNotifyNoResponse
 func (s *Session) Response(req RequestHeader, v interface{}) error {
-	return s.Write(MessageRequest, req.GetMsgId(), "", v)
+	return s.respond(req.GetMsgId(), v)
+}
+
+func (s *Session) ResponseError(req RequestHeader, code int, msg string) error {
+	return s.respondError(req.GetMsgId(), code, msg)
+}
+
+func (s *Session) expectResponse(id uint) {
+	s.reqMutex.Lock()
+	// a reused id replaces the old request, its timer must not answer the new one
+	if t := s.inflight[id]; t != nil {
+		t.Stop()
+	}
+	s.inflight[id] = nil
+	s.reqMutex.Unlock()
+}
+
+// waitResponse replies CodeNoResponse if the request is still not responded after d.
+// d <= 0 means no timeout, the request stays inflight until the handler responds
+// or the session is closed.
+func (s *Session) waitResponse(id uint, d time.Duration) {
+	s.reqMutex.Lock()
+	defer s.reqMutex.Unlock()
+
+	if _, ok := s.inflight[id]; !ok || d <= 0 {
+		return
+	}
+
+	s.inflight[id] = time.AfterFunc(d, func() {
+		Logger.Warnf("%v request %d got no response in %v", s, id, d)
+		s.respondError(id, CodeNoResponse, "no response")
+	})
+}
+
+func (s *Session) respond(id uint, v interface{}) error {
+	if id == 0 {
+		return ErrNotifyNoResponse
+	}
+
+	s.reqMutex.Lock()
+	t, ok := s.inflight[id]
+	delete(s.inflight, id)
+	s.reqMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%v response to unknown or responded request %d", s, id)
+	}
+
+	if t != nil {
+		t.Stop()
+	}
+
+	s.reqMutex.Lock()
+	ch, captured := s.captures[id]
+	delete(s.captures, id)
+	s.reqMutex.Unlock()
+
+	if captured {
+		ch <- NewMessage(MessageResponse, id, "", v)
+		return nil
+	}
+	return s.Write(MessageResponse, id, "", v)
+}
+
+// captureResponse allocates a message id whose response is delivered to ch
+// instead of the connection. The ids start from httpReqIdBase, connections
+// reject client requests with such ids so they never collide.
+func (s *Session) captureResponse() (uint, chan *Message) {
+	ch := make(chan *Message, 1)
+
+	s.reqMutex.Lock()
+	defer s.reqMutex.Unlock()
+
+	s.httpReqId++
+	id := httpReqIdBase + s.httpReqId%httpReqIdBase
+	s.captures[id] = ch
+	return id, ch
+}
+
+func (s *Session) releaseCapture(id uint) {
+	s.reqMutex.Lock()
+	delete(s.captures, id)
+	s.reqMutex.Unlock()
+}
+
+func (s *Session) respondError(id uint, code int, msg string) error {
+	return s.respond(id, &ErrorResponse{Code: code, Error: msg})
+}
+
+// Request sends a request to the client and waits for its response, the response
+// body is unmarshaled into resp which could be nil, *[]byte or a json target. A
+// reply with an error code other than CodeOK returns *RequestError.
+func (s *Session) Request(ctx context.Context, route string, v interface{}, resp interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, SessionRequestTimeout)
+		defer cancel()
+	}
+
+	ch := make(chan *Message, 1)
+
+	s.reqMutex.Lock()
+	if s.isClosed() {
+		s.reqMutex.Unlock()
+		return ErrSessionClosed
+	}
+	s.reqId++
+	if s.reqId == 0 {
+		s.reqId++
+	}
+	id := s.reqId
+	s.pending[id] = ch
+	s.reqMutex.Unlock()
+
+	defer func() {
+		s.reqMutex.Lock()
+		delete(s.pending, id)
+		s.reqMutex.Unlock()
+	}()
+
+	if err := s.Write(MessageRequest, id, route, v); err != nil {
+		return err
+	}
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return ErrSessionClosed
+		}
+
+		errResp := ErrorResponse{}
+		if json.Unmarshal(msg.Data, &errResp) == nil && errResp.Code != 0 && errResp.Code != CodeOK {
+			return &RequestError{Code: errResp.Code, Message: errResp.Error}
+		}
+
+		if resp == nil {
+			return nil
+		}
+
+		if raw, ok := resp.(*[]byte); ok {
+			*raw = msg.Data
+			return nil
+		}
+		return json.Unmarshal(msg.Data, resp)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// onResponse routes a response from the client to the goroutine waiting in Request
+func (s *Session) onResponse(msg *Message) {
+	s.reqMutex.Lock()
+	ch, ok := s.pending[msg.ID]
+	delete(s.pending, msg.ID)
+	s.reqMutex.Unlock()
+
+	if !ok {
+		Logger.Warnf("%v unexpected response id %d", s, msg.ID)
+		return
+	}
+	ch <- msg
+}
+
+// PushCoalesced pushes v but replaces any undelivered push with the same route and
+// key, only the latest value is delivered
+func (s *Session) PushCoalesced(route string, key string, v interface{}) error {
+	if s.isClosed() {
+		return fmt.Errorf("%v write closed session", s)
+	}
+
+	msg := NewMessage(MessagePush, 0, route, v)
+	msg.CoalesceKey = route + "\x00" + key
+	return s.writeMsg(msg)
+}
+
+// PushWithPriority pushes v in the lane of priority, PriorityHigh is written
+// before all queued normal messages
+func (s *Session) PushWithPriority(priority Priority, route string, v interface{}) error {
+	return s.WriteWithPriority(priority, MessagePush, 0, route, v)
 }
 
 func (s *Session) Write(t MessageType, msgId uint, route string, data interface{}) error {
-	if s.status == SessionStatusClosed {
+	return s.WriteWithPriority(PriorityNormal, t, msgId, route, data)
+}
+
+func (s *Session) WriteWithPriority(priority Priority, t MessageType, msgId uint, route string, data interface{}) error {
+	if s.isClosed() {
 		return fmt.Errorf("%v write closed session", s)
 	}
 
+	if priority < 0 || priority >= priorityCount {
+		priority = PriorityNormal
+	}
+
 	msg := NewMessage(t, msgId, route, data)
+	msg.Priority = priority
+	return s.writeMsg(msg)
+}
+
+func (s *Session) writeMsg(msg *Message) error {
+	var conn *KitConn
+	for {
+		s.Lock()
+		if s.status == SessionStatusClosed {
+			s.Unlock()
+			return fmt.Errorf("%v write closed session", s)
+		}
+
+		// the connection just written is closing, keep the message for resuming
+		if s.conn == nil || s.conn == conn {
+			err := s.delayMsg(msg)
+			if err == nil {
+				s.scheduleSave()
+			}
+			s.Unlock()
+			return err
+		}
+		conn = s.conn
+		s.Unlock()
+
+		err := conn.WriteMsg(msg)
+		if err != ErrInvalidConnStatus {
+			return err
+		}
+	}
+}
 
-	if s.conn == nil {
-		if len(s.delayMsgs) >= SessionMaxDelayMsgCount {
-			return fmt.Errorf("%v delayMsgs reach max count %d", s, SessionMaxDelayMsgCount)
-		} else {
-			s.delayMsgs = append(s.delayMsgs, msg)
+// delayMsg must be called with lock held
+func (s *Session) delayMsg(msg *Message) error {
+	if msg.CoalesceKey != "" {
+		for i, m := range s.delayMsgs {
+			if m.CoalesceKey == msg.CoalesceKey {
+				s.delayMsgs[i] = msg
+				return nil
+			}
 		}
-	} else {
-		return s.conn.WriteMsg(msg)
 	}
 
+	if len(s.delayMsgs) >= SessionMaxDelayMsgCount {
+		return fmt.Errorf("%v delayMsgs reach max count %d", s, SessionMaxDelayMsgCount)
+	}
+	s.delayMsgs = append(s.delayMsgs, msg)
 	return nil
 }
 
@@ -143,6 +567,10 @@ func (s *Session) Set(key string, value interface{}) {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.data == nil {
+		// closed
+		return
+	}
 	s.data[key] = value
 }
 
@@ -160,3 +588,108 @@ func (s *Session) Value(key string) interface{} {
 
 	return s.data[key]
 }
+
+func (s *Session) snapshot() *SessionSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	s.version++
+	snapshot := &SessionSnapshot{
+		Id:               s.Id,
+		Version:          s.version,
+		LostConnection:   s.LostConnection,
+		Data:             make(map[string][]byte),
+		DelayMsgs:        append([]*Message(nil), s.delayMsgs...),
+		ResumeNonce:      s.resumeNonce,
+		PrevResumeNonce:  s.prevResumeNonce,
+		PrevResumeExpire: s.prevResumeExpire,
+		Identity:         s.certHash,
+	}
+
+	// a connected session is snapshotted while the process is going away,
+	// the expire timeout should be counted from now on
+	if snapshot.LostConnection.IsZero() {
+		snapshot.LostConnection = time.Now()
+	}
+
+	for k, v := range s.data {
+		codec := getSessionCodec(k)
+		if codec == nil {
+			continue
+		}
+
+		data, err := codec.Encode(v)
+		if err != nil {
+			Logger.Errorf("%v encode session value %s error %v", s, k, err)
+			continue
+		}
+		snapshot.Data[k] = data
+	}
+	return snapshot
+}
+
+func (s *Session) restore(snapshot *SessionSnapshot) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.version = snapshot.Version
+	s.LostConnection = snapshot.LostConnection
+	s.delayMsgs = append([]*Message(nil), snapshot.DelayMsgs...)
+	s.resumeNonce = snapshot.ResumeNonce
+	s.prevResumeNonce = snapshot.PrevResumeNonce
+	s.prevResumeExpire = snapshot.PrevResumeExpire
+	s.certHash = snapshot.Identity
+
+	for k, data := range snapshot.Data {
+		codec := getSessionCodec(k)
+		if codec == nil {
+			Logger.Warnf("%v no codec for session value %s", s, k)
+			continue
+		}
+
+		v, err := codec.Decode(data)
+		if err != nil {
+			Logger.Errorf("%v decode session value %s error %v", s, k, err)
+			continue
+		}
+		s.data[k] = v
+	}
+}
+
+// Save writes the session into SessionManager.Store, it is called automatically when
+// the session loses its connection
+func (s *Session) Save() error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	// checked inside saveMutex, so nothing is saved after removeSession deleted it
+	if s.isClosed() {
+		return fmt.Errorf("%v save closed session", s)
+	}
+
+	m := s.Manager
+	if m == nil || m.Store == nil {
+		return nil
+	}
+	return m.Store.Save(s.snapshot())
+}
+
+func (s *Session) save() {
+	if err := s.Save(); err != nil {
+		Logger.Errorf("%v save error %v", s, err)
+	}
+}
+
+// scheduleSave saves the session after SessionManager.SaveDelay, so a burst of writes
+// costs one save. It must be called with lock held.
+func (s *Session) scheduleSave() {
+	if s.saveTimer != nil {
+		return
+	}
+	s.saveTimer = time.AfterFunc(s.Manager.SaveDelay, func() {
+		s.Lock()
+		s.saveTimer = nil
+		s.Unlock()
+		s.save()
+	})
+}
@@ -0,0 +1,97 @@
+package kit
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryQueue is a min-heap of sessions which lost connection ordered by the
+// time they expire, so CheckExpire only visits expired sessions
+type expiryQueue struct {
+	mutex sync.Mutex
+	items expiryHeap
+	wake  chan struct{} // the nearest deadline changed
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{wake: make(chan struct{}, 1)}
+}
+
+// schedule adds the session or moves its deadline
+func (q *expiryQueue) schedule(s *Session, deadline time.Time) {
+	q.mutex.Lock()
+	s.expireAt = deadline
+	if s.expireIndex < 0 {
+		heap.Push(&q.items, s)
+	} else {
+		heap.Fix(&q.items, s.expireIndex)
+	}
+	first := s.expireIndex == 0
+	q.mutex.Unlock()
+
+	if first {
+		signal(q.wake)
+	}
+}
+
+func (q *expiryQueue) cancel(s *Session) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if s.expireIndex >= 0 {
+		heap.Remove(&q.items, s.expireIndex)
+	}
+}
+
+// popExpired removes sessions expired at now, and returns the nearest deadline
+// of the rest, zero if empty
+func (q *expiryQueue) popExpired(now time.Time) ([]*Session, time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var expired []*Session
+	for len(q.items) > 0 {
+		s := q.items[0]
+		if s.expireAt.After(now) {
+			return expired, s.expireAt
+		}
+		heap.Pop(&q.items)
+		expired = append(expired, s)
+	}
+	return expired, time.Time{}
+}
+
+func (q *expiryQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+type expiryHeap []*Session
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expireIndex = i
+	h[j].expireIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	s := x.(*Session)
+	s.expireIndex = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.expireIndex = -1
+	*h = old[:n-1]
+	return s
+}
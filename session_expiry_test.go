@@ -0,0 +1,106 @@
+package kit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var benchSessionCounts = []int{1000, 10000, 100000}
+
+// newLostSessions returns a manager of n sessions waiting for resuming, none of
+// them expires during the benchmark
+func newLostSessions(shards, n int) *SessionManager {
+	m := NewShardedSessionManager(shards)
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		s := m.createSession()
+		s.Lock()
+		s.lose(now)
+		s.Unlock()
+	}
+	return m
+}
+
+// scanExpired is a pass of CheckExpire before sessions were kept in a heap, it
+// ran every second and visited every session
+func scanExpired(m *SessionManager, deadline time.Time) []*Session {
+	var expired []*Session
+	m.Range(func(s *Session) bool {
+		s.RLock()
+		lost := !s.LostConnection.IsZero() && s.LostConnection.Before(deadline)
+		s.RUnlock()
+		if lost {
+			expired = append(expired, s)
+		}
+		return true
+	})
+	return expired
+}
+
+func TestSessionManagerStop(t *testing.T) {
+	m := NewSessionManager()
+	done := make(chan struct{})
+	go func() {
+		m.CheckExpire()
+		close(done)
+	}()
+
+	m.Stop()
+	m.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CheckExpire still running after Stop")
+	}
+}
+
+// BenchmarkExpireScan is a tick of the old CheckExpire, on the single map it used
+func BenchmarkExpireScan(b *testing.B) {
+	for _, n := range benchSessionCounts {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			m := newLostSessions(1, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				deadline := time.Now().Add(-SessionExpireTimeout)
+				if len(scanExpired(m, deadline)) != 0 {
+					b.Fatal("expired during benchmark")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkExpireHeap is a wakeup of CheckExpire
+func BenchmarkExpireHeap(b *testing.B) {
+	for _, n := range benchSessionCounts {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			m := newLostSessions(1, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if expired, _ := m.expiry.popExpired(time.Now()); len(expired) != 0 {
+					b.Fatal("expired during benchmark")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkExpireLoseResume is what the heap adds to losing connection and
+// resuming, the old code only set LostConnection
+func BenchmarkExpireLoseResume(b *testing.B) {
+	for _, n := range benchSessionCounts {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			m := newLostSessions(1, n)
+			s := m.createSession()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Lock()
+				s.lose(time.Now())
+				s.LostConnection = time.Time{}
+				m.expiry.cancel(s)
+				s.Unlock()
+			}
+		})
+	}
+}
@@ -1,54 +1,270 @@
 package kit
 
 import (
+	"hash/maphash"
+	"runtime"
 	"sync"
 	"time"
 )
 
+var SessionExpireTimeout = 20 * time.Second // 断线后保留Session的时间
+
+// SessionShards is the shard count of sessions used by NewSessionManager, sessions
+// are hashed by id so connecting clients rarely wait for each other. Zero means
+// runtime.GOMAXPROCS(0), more shards than cores only add hashing, see
+// BenchmarkSessionLookup.
+var SessionShards = 0
+
 type SessionManager struct {
+	sync.RWMutex // guards hooks
+	Store        SessionStore
+	// SaveDelay batches saving messages written to a disconnected session, they
+	// are saved into Store together once it passed
+	SaveDelay time.Duration
+	shards    []*sessionShard
+	seed      maphash.Seed
+	hooks     []*SessionHooks
+	expiry    *expiryQueue
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type sessionShard struct {
 	sync.RWMutex
 	pool map[string]*Session
 }
 
 func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		pool: make(map[string]*Session),
+	n := SessionShards
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
 	}
+	return NewShardedSessionManager(n)
+}
+
+// NewShardedSessionManager creates a SessionManager with n shards, one shard is a
+// single map behind one lock
+func NewShardedSessionManager(n int) *SessionManager {
+	if n < 1 {
+		n = 1
+	}
+
+	m := &SessionManager{
+		Store:     NewMemorySessionStore(),
+		SaveDelay: SessionSaveDelay,
+		shards:    make([]*sessionShard, n),
+		seed:      maphash.MakeSeed(),
+		expiry:    newExpiryQueue(),
+		stop:      make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = &sessionShard{pool: make(map[string]*Session)}
+	}
+	return m
+}
+
+func (m *SessionManager) shard(id string) *sessionShard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
+	}
+	var h maphash.Hash
+	h.SetSeed(m.seed)
+	h.WriteString(id)
+	return m.shards[h.Sum64()%uint64(len(m.shards))]
 }
 
 func (m *SessionManager) GetSessionById(id string) *Session {
-	m.RLock()
-	defer m.RUnlock()
-	if session, ok := m.pool[id]; ok {
+	shard := m.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	if session, ok := shard.pool[id]; ok {
 		return session
 	}
 	return nil
 }
 
-func (m *SessionManager) createSession() *Session {
-	m.Lock()
-	defer m.Unlock()
+// Count returns the number of sessions, connected or waiting for resuming
+func (m *SessionManager) Count() int {
+	n := 0
+	for _, shard := range m.shards {
+		shard.RLock()
+		n += len(shard.pool)
+		shard.RUnlock()
+	}
+	return n
+}
+
+// Range calls fn for every session until it returns false. A shard is locked while
+// its sessions are visited, so fn must not close sessions or block, use Snapshot
+// for that.
+func (m *SessionManager) Range(fn func(s *Session) bool) {
+	for _, shard := range m.shards {
+		shard.RLock()
+		for _, session := range shard.pool {
+			if !fn(session) {
+				shard.RUnlock()
+				return
+			}
+		}
+		shard.RUnlock()
+	}
+}
+
+// Snapshot returns all sessions at the moment, sessions created or closed later
+// are not reflected
+func (m *SessionManager) Snapshot() []*Session {
+	sessions := make([]*Session, 0, m.Count())
+	m.Range(func(s *Session) bool {
+		sessions = append(sessions, s)
+		return true
+	})
+	return sessions
+}
+
+// resumeSession finds the session in the pool, or rehydrates it from Store
+func (m *SessionManager) resumeSession(id string) *Session {
+	if session := m.GetSessionById(id); session != nil {
+		return session
+	}
+
+	if m.Store == nil {
+		return nil
+	}
+
+	snapshot, err := m.Store.Load(id)
+	if err != nil {
+		Logger.Errorf("SessionManager load session %s error %v", id, err)
+		return nil
+	}
+
+	if snapshot == nil {
+		return nil
+	}
+
+	if !snapshot.LostConnection.IsZero() && snapshot.LostConnection.Before(time.Now().Add(-SessionExpireTimeout)) {
+		Logger.Debugf("SessionManager stored session %s expired", id)
+		m.deleteSnapshot(id, snapshot.Version)
+		return nil
+	}
+
+	shard := m.shard(id)
+	shard.Lock()
+
+	// another connection may have restored it meanwhile
+	if session, ok := shard.pool[id]; ok {
+		shard.Unlock()
+		return session
+	}
 
 	session := newSession(m)
-	m.pool[session.Id] = session
+	session.Id = id
+	session.restore(snapshot)
+	shard.pool[session.Id] = session
+
+	// expires unless a connection is attached in time
+	session.Lock()
+	session.lose(session.LostConnection)
+	session.Unlock()
+	shard.Unlock()
+
+	// a newer version claims it, the node it came from does not delete it on expiry
+	session.save()
+	return session
+}
+
+func (m *SessionManager) createSession() *Session {
+	session := newSession(m)
+	shard := m.shard(session.Id)
+	shard.Lock()
+	shard.pool[session.Id] = session
+	shard.Unlock()
+
+	m.fireSessionCreated(session)
 	return session
 }
 
 func (m *SessionManager) removeSession(s *Session) {
-	m.Lock()
-	delete(m.pool, s.Id)
-	m.Unlock()
+	shard := m.shard(s.Id)
+	shard.Lock()
+	if shard.pool[s.Id] == s {
+		delete(shard.pool, s.Id)
+	}
+	shard.Unlock()
+
+	if m.Store == nil {
+		return
+	}
+
+	// ordered after saves in flight, later saves see the session closed
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	s.RLock()
+	version := s.version
+	s.RUnlock()
+
+	if err := m.deleteSnapshot(s.Id, version); err != nil {
+		Logger.Errorf("SessionManager delete %v error %v", s, err)
+	}
+}
+
+// deleteSnapshot keeps snapshots newer than version if Store supports it
+func (m *SessionManager) deleteSnapshot(id string, version uint64) error {
+	if d, ok := m.Store.(SessionVersionDeleter); ok {
+		return d.DeleteVersion(id, version)
+	}
+	return m.Store.Delete(id)
+}
+
+// SaveAll writes every session into Store, call it before the process exits so
+// clients can resume their sessions after restart
+func (m *SessionManager) SaveAll() error {
+	var lastErr error
+	for _, session := range m.Snapshot() {
+		if err := session.Save(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
+// CheckExpire closes sessions not resumed SessionExpireTimeout after losing
+// connection until Stop. It sleeps until the nearest deadline, so idle sessions
+// cost nothing.
 func (m *SessionManager) CheckExpire() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 	for {
-		// 20秒超时
-		expiredTime := time.Now().Add(-20 * time.Second)
-		for _, session := range m.pool {
-			if !session.LostConnection.IsZero() && session.LostConnection.Before(expiredTime) {
-				session.Close("lose connection and expired")
+		now := time.Now()
+		expired, next := m.expiry.popExpired(now)
+
+		// Close removes the session from pool, so close them after unlocking
+		for _, session := range expired {
+			session.closeExpired(now)
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = next.Sub(now)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
 		}
-		time.Sleep(time.Second)
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-m.expiry.wake:
+		case <-m.stop:
+			return
+		}
 	}
 }
+
+// Stop ends CheckExpire, sessions are kept and no longer expire
+func (m *SessionManager) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
@@ -0,0 +1,39 @@
+package kit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkSessionLookup looks up sessions from all procs while every 64th
+// lookup creates and closes one, like resuming during a reconnect storm. One
+// shard is what SessionManager was before sharding.
+func BenchmarkSessionLookup(b *testing.B) {
+	for _, shards := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			m := NewShardedSessionManager(shards)
+			m.Store = nil
+			ids := make([]string, 10000)
+			for i := range ids {
+				ids[i] = m.createSession().Id
+			}
+
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := atomic.AddUint64(&next, 1) * 7919
+				for pb.Next() {
+					i++
+					if i%64 == 0 {
+						m.createSession().Close("lookup benchmark")
+						continue
+					}
+					if m.GetSessionById(ids[i%uint64(len(ids))]) == nil {
+						b.Fatal("session not found")
+					}
+				}
+			})
+		})
+	}
+}
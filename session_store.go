@@ -0,0 +1,251 @@
+package kit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var ErrInvalidSessionId = errors.New("invalid session id")
+
+// SessionSnapshot is the serializable state of a session
+type SessionSnapshot struct {
+	Id               string            `json:"id"`
+	Version          uint64            `json:"version"` // increased by every save
+	LostConnection   time.Time         `json:"lost_connection"`
+	Data             map[string][]byte `json:"data"`
+	DelayMsgs        []*Message        `json:"delay_msgs"`
+	ResumeNonce      []byte            `json:"resume_nonce,omitempty"`
+	PrevResumeNonce  []byte            `json:"prev_resume_nonce,omitempty"`
+	PrevResumeExpire time.Time         `json:"prev_resume_expire"`
+	Identity         []byte            `json:"identity,omitempty"` // fingerprint of the bound client certificate
+}
+
+// SessionStore keeps session snapshots outside of the process, Load returns nil, nil
+// if the session can not be found
+type SessionStore interface {
+	Save(snapshot *SessionSnapshot) error
+	Load(id string) (*SessionSnapshot, error)
+	Delete(id string) error
+}
+
+// SessionVersionDeleter is implemented by stores which could delete a snapshot only
+// if it is not newer than version, so a session expired on one node does not
+// delete the snapshot saved by another node which resumed it
+type SessionVersionDeleter interface {
+	DeleteVersion(id string, version uint64) error
+}
+
+// SessionValueCodec converts a value stored by Session.Set into bytes and back
+type SessionValueCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+var (
+	sessionCodecs      = make(map[string]SessionValueCodec)
+	sessionCodecsMutex sync.RWMutex
+)
+
+// RegisterSessionCodec makes the session value with the given key persistent,
+// values without a registered codec are not saved into SessionStore
+func RegisterSessionCodec(key string, codec SessionValueCodec) {
+	sessionCodecsMutex.Lock()
+	defer sessionCodecsMutex.Unlock()
+
+	if _, ok := sessionCodecs[key]; ok {
+		panic(fmt.Errorf("session codec with key %s already existed", key))
+	}
+	sessionCodecs[key] = codec
+}
+
+func getSessionCodec(key string) SessionValueCodec {
+	sessionCodecsMutex.RLock()
+	defer sessionCodecsMutex.RUnlock()
+
+	return sessionCodecs[key]
+}
+
+// JSONSessionCodec encodes session values with encoding/json
+type JSONSessionCodec struct {
+	typ reflect.Type
+}
+
+// NewJSONSessionCodec returns a codec which decodes into the type of sample
+func NewJSONSessionCodec(sample interface{}) *JSONSessionCodec {
+	return &JSONSessionCodec{typ: reflect.TypeOf(sample)}
+}
+
+func (c *JSONSessionCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *JSONSessionCodec) Decode(data []byte) (interface{}, error) {
+	if c.typ.Kind() == reflect.Ptr {
+		v := reflect.New(c.typ.Elem())
+		if err := json.Unmarshal(data, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+
+	v := reflect.New(c.typ)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// MemorySessionStore is the default SessionStore, it only survives SessionManager
+// pool misses inside one process
+type MemorySessionStore struct {
+	sync.RWMutex
+	snapshots map[string]*SessionSnapshot
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		snapshots: make(map[string]*SessionSnapshot),
+	}
+}
+
+func (m *MemorySessionStore) Save(snapshot *SessionSnapshot) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if old, ok := m.snapshots[snapshot.Id]; ok && old.Version > snapshot.Version {
+		return nil
+	}
+	m.snapshots[snapshot.Id] = snapshot
+	return nil
+}
+
+func (m *MemorySessionStore) Load(id string) (*SessionSnapshot, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.snapshots[id], nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.snapshots, id)
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteVersion(id string, version uint64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if old, ok := m.snapshots[id]; ok && old.Version <= version {
+		delete(m.snapshots, id)
+	}
+	return nil
+}
+
+// FileSessionStore saves every session as a json file inside Dir, it can be shared
+// by nodes mounting the same directory
+type FileSessionStore struct {
+	Dir string
+}
+
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{Dir: dir}, nil
+}
+
+func (f *FileSessionStore) path(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return "", ErrInvalidSessionId
+	}
+	return filepath.Join(f.Dir, id+".json"), nil
+}
+
+func (f *FileSessionStore) Save(snapshot *SessionSnapshot) error {
+	p, err := f.path(snapshot.Id)
+	if err != nil {
+		return err
+	}
+
+	// best effort between nodes, a newer snapshot is kept
+	if old, err := f.Load(snapshot.Id); err == nil && old != nil && old.Version > snapshot.Version {
+		return nil
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so readers never see a partial snapshot
+	tmp, err := ioutil.TempFile(f.Dir, snapshot.Id+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *FileSessionStore) Load(id string) (*SessionSnapshot, error) {
+	p, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshot := &SessionSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (f *FileSessionStore) Delete(id string) error {
+	p, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteVersion is best effort between nodes, the file could be replaced between
+// loading and removing it
+func (f *FileSessionStore) DeleteVersion(id string, version uint64) error {
+	old, err := f.Load(id)
+	if err != nil || old == nil {
+		return err
+	}
+	if old.Version > version {
+		return nil
+	}
+	return f.Delete(id)
+}
@@ -0,0 +1,92 @@
+package kit
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testStoreVersions(t *testing.T, store SessionStore) {
+	store.Save(&SessionSnapshot{Id: "s1", Version: 2})
+	store.Save(&SessionSnapshot{Id: "s1", Version: 1})
+
+	if snapshot, _ := store.Load("s1"); snapshot == nil || snapshot.Version != 2 {
+		t.Fatalf("older snapshot replaced the newer one: %+v", snapshot)
+	}
+
+	d := store.(SessionVersionDeleter)
+	d.DeleteVersion("s1", 1)
+	if snapshot, _ := store.Load("s1"); snapshot == nil {
+		t.Fatal("newer snapshot deleted")
+	}
+
+	d.DeleteVersion("s1", 2)
+	if snapshot, _ := store.Load("s1"); snapshot != nil {
+		t.Fatal("snapshot not deleted")
+	}
+}
+
+func TestMemorySessionStoreVersions(t *testing.T) {
+	testStoreVersions(t, NewMemorySessionStore())
+}
+
+func TestFileSessionStoreVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoreVersions(t, store)
+}
+
+func TestSnapshotCopiesDelayMsgs(t *testing.T) {
+	m := NewSessionManager()
+	s := m.createSession()
+	s.Push("a", 1)
+
+	snapshot := s.snapshot()
+	s.Push("b", 2)
+	snapshot.DelayMsgs[0] = nil
+
+	s.RLock()
+	defer s.RUnlock()
+	if len(snapshot.DelayMsgs) != 1 || len(s.delayMsgs) != 2 || s.delayMsgs[0] == nil {
+		t.Fatal("snapshot shares delayMsgs with the session")
+	}
+}
+
+func TestDelayedWritesSaveOnce(t *testing.T) {
+	store := &countingStore{SessionStore: NewMemorySessionStore()}
+	m := NewSessionManager()
+	m.Store = store
+	m.SaveDelay = 0
+
+	s := m.createSession()
+	s.Lock()
+	// hold the timer back until all writes are queued
+	s.saveTimer = newStoppedTimer()
+	s.Unlock()
+
+	for i := 0; i < 10; i++ {
+		s.Push("p", i)
+	}
+	if n := store.count(); n != 0 {
+		t.Fatalf("saved %d times while a save is pending", n)
+	}
+
+	s.Lock()
+	s.saveTimer = nil
+	s.Unlock()
+	s.Push("p", 10)
+	waitUntil(t, func() bool { return store.count() == 1 })
+
+	snapshot, _ := store.Load(s.Id)
+	if len(snapshot.DelayMsgs) != 11 {
+		t.Fatalf("saved %d delayMsgs", len(snapshot.DelayMsgs))
+	}
+}
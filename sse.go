@@ -0,0 +1,269 @@
+package kit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSETokenHeader carries resume tokens of ServeSSE, tokens are kept out of URLs
+// which end up in logs and browser history
+const SSETokenHeader = "X-Kit-Token"
+
+var (
+	errSSEClosed       = errors.New("sse connection closed")
+	errSSENotSupported = errors.New("streaming unsupported")
+)
+
+// sseConn is an adapter to net.Conn, packets written by KitConn are sent as
+// server-sent events, nothing is ever read from it
+type sseConn struct {
+	mutex   sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	local   net.Addr
+	remote  net.Addr
+	decoder *PacketDecoder
+	closed  chan struct{}
+	once    sync.Once
+
+	readMutex  sync.Mutex
+	readTimer  *time.Timer
+	expired    chan struct{} // read deadline passed
+	expireOnce sync.Once
+}
+
+// Read blocks until the client goes away or the read deadline, which KitConn
+// sets after writing the close packet
+func (c *sseConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.EOF
+	case <-c.expired:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *sseConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.closed:
+		return 0, errSSEClosed
+	default:
+	}
+
+	packets, err := c.decoder.Decode(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range packets {
+		switch p.Type {
+		case PacketData:
+			// the same message encoding as websocket, base64 makes it text-safe
+			fmt.Fprintf(c.w, "event: message\ndata: %s\n\n", base64.StdEncoding.EncodeToString(p.Data))
+		case PacketHeartbeat:
+			io.WriteString(c.w, ": heartbeat\n\n")
+		case PacketClose:
+			io.WriteString(c.w, "event: close\ndata: {}\n\n")
+		case PacketHandshake:
+			fmt.Fprintf(c.w, "event: handshake\ndata: %s\n\n", p.Data)
+		}
+	}
+	c.flusher.Flush()
+	return len(b), nil
+}
+
+func (c *sseConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *sseConn) LocalAddr() net.Addr                { return c.local }
+func (c *sseConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *sseConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *sseConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline only supports one deadline, nothing is read so Read never
+// continues after it
+func (c *sseConn) SetReadDeadline(t time.Time) error {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+	c.readTimer = time.AfterFunc(time.Until(t), func() {
+		c.expireOnce.Do(func() { close(c.expired) })
+	})
+	return nil
+}
+
+// ServeSSE serves push-only clients, the resume token is sent in SSETokenHeader.
+// GET subscribes to pushes of the session (a new one if token is empty or
+// invalid) as server-sent events, the first event is "handshake" carrying a new
+// resume token and every "message" event is a base64 encoded Message. POST
+// ?route= with a json body calls the route, the response is the body of the
+// reply, add notify=1 for notify. Every token is valid once, POST responses
+// carry the next one in SSETokenHeader. webclient/sse.js is the browser client.
+func (s *Server) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if s.RequireEncryption {
+		http.Error(w, "encryption required", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.subscribeSSE(w, r)
+	case http.MethodPost:
+		s.requestSSE(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) subscribeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, errSSENotSupported.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	release, code, err := s.admit(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		Logger.Warnf("sse from %s rejected: %v", r.RemoteAddr, err)
+		return
+	}
+	defer release()
+
+	identity := peerIdentityFromTLS(r.TLS)
+
+	var session *Session
+	var resumeToken string
+	if token := r.Header.Get(SSETokenHeader); token != "" {
+		session, resumeToken = s.resumeSession(token, identity)
+	}
+	if session == nil {
+		session = s.SessionManager.createSession()
+		resumeToken = s.issueResumeToken(session)
+	}
+
+	local := net.Addr(pollAddr(r.Host))
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	}
+
+	c := &sseConn{
+		w:       w,
+		flusher: flusher,
+		local:   local,
+		remote:  pollAddr(r.RemoteAddr),
+		decoder: NewPacketDecoder(),
+		closed:  make(chan struct{}),
+		expired: make(chan struct{}),
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	go func() {
+		<-r.Context().Done()
+		c.Close()
+	}()
+
+	kitConn := NewKitConn(s, c)
+	kitConn.Identity = identity
+	kitConn.attachSession(session, resumeToken)
+	kitConn.Handle()
+}
+
+func (s *Server) requestSSE(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	route := strings.ToLower(q.Get("route"))
+	if route == "" {
+		http.Error(w, "route is required", http.StatusBadRequest)
+		return
+	}
+
+	// counted like connections while waiting for the handler
+	release, code, err := s.admit(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		Logger.Warnf("sse request from %s rejected: %v", r.RemoteAddr, err)
+		return
+	}
+	defer release()
+
+	// the token is consumed like a reconnect, so a leaked one is useless once used
+	session, next := s.resumeSession(r.Header.Get(SSETokenHeader), peerIdentityFromTLS(r.TLS))
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set(SSETokenHeader, next)
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, PacketMaxSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > PacketMaxSize {
+		http.Error(w, ErrPacketSizeExcced.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("{}")
+	}
+
+	if q.Get("notify") == "1" {
+		msg := &Message{Type: MessageNotify, Route: route, Data: data}
+		if !s.checkRateLimit(session, msg) {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		s.Route.Exec(session, msg)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	id, ch := session.captureResponse()
+	defer session.releaseCapture(id)
+
+	msg := &Message{Type: MessageRequest, ID: id, Route: route, Data: data}
+	if !s.checkRateLimit(session, msg) {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	s.Route.Exec(session, msg)
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			http.Error(w, ErrSessionClosed.Error(), http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp.Data)
+	case <-r.Context().Done():
+	}
+}
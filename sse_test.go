@@ -0,0 +1,111 @@
+package kit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSE(t *testing.T) {
+	server := NewServer(NewRoute())
+	server.MaxConnections = 1
+	attached := make(chan *Session, 1)
+	server.AddHooks(&SessionHooks{
+		OnConnAttached: func(s *Session, c *KitConn) { attached <- s },
+	})
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeSSE))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	session := <-attached
+
+	// POST is admitted like a connection
+	post, err := http.Post(ts.URL+"?route=a.b", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("POST over MaxConnections returned %d", post.StatusCode)
+	}
+
+	start := time.Now()
+	session.Close("bye")
+	events := bufio.NewScanner(resp.Body)
+	closed := false
+	for events.Scan() {
+		closed = closed || strings.HasPrefix(events.Text(), "event: close")
+	}
+	if !closed {
+		t.Fatal("close event not received")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("stream ended %v after server close", d)
+	}
+}
+
+func postSSE(t *testing.T, url, token string) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, url+"?route=echo.say", strings.NewReader(`{"text":"hi"}`))
+	req.Header.Set(SSETokenHeader, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSSETokenConsumed(t *testing.T) {
+	route := NewRoute()
+	route.Reg("echo", &Echo{})
+	server := NewServer(route)
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeSSE))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events := bufio.NewScanner(resp.Body)
+	hs := HandshakeResponse{}
+	for events.Scan() {
+		if line := events.Text(); strings.HasPrefix(line, "data: ") {
+			json.Unmarshal([]byte(line[6:]), &hs)
+			break
+		}
+	}
+	if hs.Token == "" {
+		t.Fatal("no token in handshake")
+	}
+
+	first := postSSE(t, ts.URL, hs.Token)
+	next := first.Header.Get(SSETokenHeader)
+	if first.StatusCode != http.StatusOK || next == "" || next == hs.Token {
+		t.Fatalf("POST returned %d with token %q", first.StatusCode, next)
+	}
+	if second := postSSE(t, ts.URL, next); second.StatusCode != http.StatusOK {
+		t.Fatalf("next token returned %d", second.StatusCode)
+	}
+	if again := postSSE(t, ts.URL, hs.Token); again.StatusCode != http.StatusNotFound {
+		t.Fatalf("reused token returned %d", again.StatusCode)
+	}
+}
+
+func TestRejectServerRequestIds(t *testing.T) {
+	server := NewServer(NewRoute())
+	c := dialTest(t, server, nil, true)
+	defer c.conn.Close()
+
+	c.sendMsg(MessageRequest, httpReqIdBase, "a.b", struct{}{})
+	c.read(PacketClose)
+}
@@ -0,0 +1,382 @@
+package kit
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// go test -race -run TestStress -stress.clients 2000 -stress.duration 30s
+var (
+	stressClients  = flag.Int("stress.clients", 200, "concurrent clients of TestStress")
+	stressDuration = flag.Duration("stress.duration", 3*time.Second, "how long TestStress runs")
+	stressRequests = flag.Int("stress.requests", 5, "requests per connection round of TestStress")
+)
+
+var errKicked = errors.New("connection closed by server")
+
+type stressStats struct {
+	connects  int64
+	resumes   int64
+	requests  int64
+	responses int64
+	pushes    int64
+	kicked    int64
+	failures  int64
+}
+
+type Stress struct {
+	rooms *RoomManager
+}
+
+type StressEchoReq struct {
+	RequestHead
+	Client int `json:"client"`
+	Seq    int `json:"seq"`
+}
+
+type StressRoomReq struct {
+	RequestHead
+	RoomHead
+}
+
+type StressJoinReq struct {
+	RequestHead
+	RoomOpenHead
+}
+
+func (h *Stress) Echo(s *Session, r *StressEchoReq) {
+	n, _ := s.Value("n").(int)
+	s.Set("n", n+1)
+	if r.Seq%7 == 0 {
+		s.After(time.Millisecond, func() { s.Push("stress.later", r.Seq) })
+	}
+	s.Response(r, r)
+}
+
+func (h *Stress) Join(s *Session, r *StressJoinReq) {
+	room := h.rooms.GetRoom(r.RoomId)
+	if err := room.Join(s); err != nil {
+		s.ResponseError(r, 409, err.Error())
+		return
+	}
+	s.Response(r, map[string]int{"members": room.Count()})
+}
+
+func (h *Stress) Leave(s *Session, r *StressRoomReq) {
+	h.rooms.GetRoom(r.RoomId).Leave(s)
+	s.Response(r, struct{}{})
+}
+
+// TestStress concurrently connects, resumes, writes and closes sessions, it
+// fails if any response is lost or mismatched
+func TestStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test skipped in short mode")
+	}
+
+	server, stop := newStressServer()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer stop()
+	addr := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	stats := &stressStats{}
+	deadline := time.Now().Add(*stressDuration)
+	var wg sync.WaitGroup
+	for i := 0; i < *stressClients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runStressClient(t, stats, addr, id, deadline)
+		}(i)
+	}
+	wg.Wait()
+
+	t.Logf("connects %d resumes %d requests %d responses %d pushes %d kicked %d",
+		atomic.LoadInt64(&stats.connects),
+		atomic.LoadInt64(&stats.resumes),
+		atomic.LoadInt64(&stats.requests),
+		atomic.LoadInt64(&stats.responses),
+		atomic.LoadInt64(&stats.pushes),
+		atomic.LoadInt64(&stats.kicked),
+	)
+	if n := atomic.LoadInt64(&stats.failures); n > 0 {
+		t.Fatalf("%d clients failed", n)
+	}
+}
+
+func newStressServer() (*Server, func()) {
+	handler := &Stress{}
+	route := NewRoute()
+	route.Reg("stress", handler)
+
+	server := NewServer(route)
+	server.HeartbeatInterval = time.Second
+	handler.rooms = NewRoomManager(server)
+	presence := NewPresence(server)
+
+	lobby, _ := handler.rooms.CreateRoom("lobby", 0, nil)
+	lobby.Every(50*time.Millisecond, func() {
+		lobby.Broadcast("stress.tick", lobby.Count())
+	})
+
+	// sessions attached, pushed to and closed from outside of their handlers
+	var mutex sync.Mutex
+	live := make(map[*Session]bool)
+	server.AddHooks(&SessionHooks{
+		OnConnAttached: func(s *Session, c *KitConn) {
+			presence.Bind(s, fmt.Sprintf("user%d", rand.Intn(100)))
+			mutex.Lock()
+			live[s] = true
+			mutex.Unlock()
+		},
+		OnSessionClosed: func(s *Session, reason string) {
+			mutex.Lock()
+			delete(live, s)
+			mutex.Unlock()
+		},
+	})
+
+	task := server.Every(10*time.Millisecond, func() {
+		mutex.Lock()
+		sessions := make([]*Session, 0, len(live))
+		for s := range live {
+			sessions = append(sessions, s)
+		}
+		mutex.Unlock()
+
+		for i, s := range sessions {
+			s.PushCoalesced("stress.push", "k", i)
+			if rand.Intn(5000) == 0 {
+				s.Close("kicked by stress")
+			}
+		}
+	})
+
+	return server, func() {
+		task.Stop()
+		lobby.Destroy()
+	}
+}
+
+type stressClient struct {
+	id    int
+	stats *stressStats
+	conn  *websocket.Conn
+	dec   *PacketDecoder
+	token string
+	seq   int
+}
+
+func stressPacket(t PacketType, data []byte) []byte {
+	b, _ := (&Packet{Type: t, Data: data}).Encode()
+	return b
+}
+
+func (c *stressClient) connect(addr string) error {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.dec = NewPacketDecoder()
+
+	hello, _ := json.Marshal(&HandshakeHead{Token: c.token, Version: ProtocolVersion})
+	if err := conn.WriteMessage(websocket.BinaryMessage, stressPacket(PacketHandshake, hello)); err != nil {
+		return err
+	}
+
+	p, err := c.read(PacketHandshake)
+	if err != nil {
+		return err
+	}
+	resp := HandshakeResponse{}
+	if err := json.Unmarshal(p.Data, &resp); err != nil {
+		return err
+	}
+	if resp.Code != CodeOK {
+		return fmt.Errorf("handshake code %d", resp.Code)
+	}
+
+	atomic.AddInt64(&c.stats.connects, 1)
+	if c.token != "" {
+		atomic.AddInt64(&c.stats.resumes, 1)
+	}
+	c.token = resp.Token
+	return conn.WriteMessage(websocket.BinaryMessage, stressPacket(PacketHandshakeAck, nil))
+}
+
+// read returns the next packet of type t, pushes are counted and skipped
+func (c *stressClient) read(t PacketType) (*Packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, err
+			}
+			return nil, errKicked
+		}
+
+		packets, err := c.dec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range packets {
+			if p.Type == PacketClose {
+				return nil, errKicked
+			}
+			if p.Type == t {
+				return p, nil
+			}
+		}
+	}
+}
+
+func (c *stressClient) readResponse(id uint) (*Message, error) {
+	for {
+		p, err := c.read(PacketData)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := DecodeMessageFromRaw(p.Data)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type == MessagePush {
+			atomic.AddInt64(&c.stats.pushes, 1)
+			continue
+		}
+		if msg.Type == MessageResponse && msg.ID == id {
+			return msg, nil
+		}
+	}
+}
+
+func (c *stressClient) request(route string, v interface{}) (*Message, error) {
+	c.seq++
+	id := uint(c.seq)
+	data, err := NewMessage(MessageRequest, id, route, v).Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&c.stats.requests, 1)
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, stressPacket(PacketData, data)); err != nil {
+		return nil, errKicked
+	}
+
+	msg, err := c.readResponse(id)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.stats.responses, 1)
+	return msg, nil
+}
+
+func (c *stressClient) echo(n int) error {
+	for i := 0; i < n; i++ {
+		req := &StressEchoReq{Client: c.id, Seq: c.seq + 1}
+		msg, err := c.request("stress.echo", req)
+		if err != nil {
+			return err
+		}
+
+		resp := StressEchoReq{}
+		if err := json.Unmarshal(msg.Data, &resp); err != nil || resp != *req {
+			return fmt.Errorf("mismatched response %s", msg.Data)
+		}
+	}
+	return nil
+}
+
+func runStressClient(t *testing.T, stats *stressStats, addr string, id int, deadline time.Time) {
+	c := &stressClient{id: id, stats: stats}
+	rnd := rand.New(rand.NewSource(int64(id)))
+	fail := func(err error) {
+		if strings.Contains(err.Error(), "connection reset") {
+			atomic.AddInt64(&stats.kicked, 1)
+			return
+		}
+		atomic.AddInt64(&stats.failures, 1)
+		t.Errorf("client %d: %v", id, err)
+	}
+
+	for time.Now().Before(deadline) {
+		if c.conn == nil {
+			if err := c.connect(addr); err != nil {
+				if err != errKicked {
+					fail(err)
+				}
+				c.conn = nil
+				continue
+			}
+		}
+
+		err := c.echo(*stressRequests)
+		if err == nil && rnd.Intn(3) == 0 {
+			room := map[string]string{"room": "lobby"}
+			if _, err = c.request("stress.join", room); err == nil {
+				_, err = c.request("stress.leave", room)
+			}
+		}
+		if err != nil {
+			if err == errKicked {
+				atomic.AddInt64(&stats.kicked, 1)
+				c.conn.Close()
+				c.conn = nil
+				continue
+			}
+			fail(err)
+			return
+		}
+
+		switch rnd.Intn(5) {
+		case 0:
+			// drop the connection, resume next round
+			c.conn.Close()
+			c.conn = nil
+		case 1:
+			// close the session
+			c.conn.WriteMessage(websocket.BinaryMessage, stressPacket(PacketClose, nil))
+			c.conn.Close()
+			c.conn = nil
+			c.token = ""
+		case 2:
+			// resume from another connection while the old one is still open,
+			// the old one is replaced
+			old := c.conn
+			err := c.connect(addr)
+			if err != nil && err != errKicked {
+				fail(err)
+			}
+			old.Close()
+			if err != nil {
+				if c.conn != old {
+					c.conn.Close()
+				}
+				c.conn = nil
+			}
+		default:
+			// keep going on the same connection
+		}
+	}
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
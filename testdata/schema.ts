@@ -0,0 +1,88 @@
+// Code generated by kitgen. DO NOT EDIT.
+
+export interface Point {
+  "x": number;
+}
+
+export interface SchemaDrawReq {
+  "trace": string;
+  "origin": Point;
+  "pixel": image_Point;
+  "root": SchemaNode | null;
+  "note"?: string;
+  "tags": { [key: string]: number };
+  "at": string;
+  "image": string;
+}
+
+export interface SchemaNode {
+  "name": string;
+  "parent": SchemaNode | null;
+  "children"?: Array<SchemaNode | null>;
+}
+
+export interface SchemaPing {
+  "at": number;
+}
+
+export interface image_Point {
+  "X": number;
+  "Y": number;
+}
+
+export interface RequestMap {
+  "schema.draw": { req: SchemaDrawReq; resp: SchemaNode };
+}
+
+export interface NotifyMap {
+  "schema.ping": SchemaPing;
+  "schema.raw": any;
+}
+
+export interface PushMap {
+  "schema.moved": Point;
+  "schema.pixel": image_Point;
+}
+
+export interface FieldError {
+  field: string;
+  rule: string;
+  message: string;
+}
+
+export interface ErrorResponse {
+  code: number;
+  error: string;
+  fields?: Array<FieldError>;
+}
+
+export function isErrorResponse(v: any): v is ErrorResponse {
+  return v != null && typeof v.code === "number" && typeof v.error === "string";
+}
+
+export interface KitSessionLike {
+  request(route: string, msg: any, cb: (data: any) => void): void;
+  notify(route: string, msg: any): void;
+  on(route: string, fn: (data: any) => void): any;
+  off(route: string, fn?: (data: any) => void): any;
+}
+
+export class TypedKitSession {
+  constructor(public readonly session: KitSessionLike) {}
+
+  request<R extends keyof RequestMap>(route: R, msg: RequestMap[R]["req"]): Promise<RequestMap[R]["resp"] | ErrorResponse> {
+    return new Promise((resolve) => this.session.request(route as string, msg, resolve));
+  }
+
+  notify<R extends keyof NotifyMap>(route: R, msg: NotifyMap[R]): void {
+    this.session.notify(route as string, msg);
+  }
+
+  on<R extends keyof PushMap>(route: R, fn: (data: PushMap[R]) => void): void {
+    this.session.on(route as string, fn);
+  }
+
+  off<R extends keyof PushMap>(route: R, fn?: (data: PushMap[R]) => void): void {
+    this.session.off(route as string, fn);
+  }
+}
@@ -0,0 +1,249 @@
+package kit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	Config   *tls.Config // base config, certificates are still loaded from CertFile/KeyFile if given
+
+	ClientCAFile      string // verify client certificates against this CA bundle
+	RequireClientCert bool   // reject clients without a valid certificate
+
+	ReloadInterval time.Duration // check cert/key files for changes, zero disables hot reload
+}
+
+// PeerIdentity is the verified client certificate of a connection
+type PeerIdentity struct {
+	CommonName  string
+	DNSNames    []string
+	URIs        []string
+	Certificate *x509.Certificate
+}
+
+func (p *PeerIdentity) String() string {
+	return fmt.Sprintf("PeerIdentity(cn=%s)", p.CommonName)
+}
+
+func (p *PeerIdentity) equal(o *PeerIdentity) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+	return p.Certificate.Equal(o.Certificate)
+}
+
+// Fingerprint is the sha256 of the certificate, it is what a saved session is bound to
+func (p *PeerIdentity) Fingerprint() []byte {
+	if p == nil || p.Certificate == nil {
+		return nil
+	}
+	sum := sha256.Sum256(p.Certificate.Raw)
+	return sum[:]
+}
+
+// matchFingerprint reports whether p is the certificate of fingerprint, nil only
+// matches nil
+func (p *PeerIdentity) matchFingerprint(fingerprint []byte) bool {
+	if p == nil || fingerprint == nil {
+		return p == nil && fingerprint == nil
+	}
+	return bytes.Equal(p.Fingerprint(), fingerprint)
+}
+
+// peerIdentityFromTLS returns nil unless the client certificate is verified
+func peerIdentityFromTLS(state *tls.ConnectionState) *PeerIdentity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	identity := &PeerIdentity{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		Certificate: cert,
+	}
+	for _, u := range cert.URIs {
+		identity.URIs = append(identity.URIs, u.String())
+	}
+	return identity
+}
+
+// CertReloader serves the certificate of CertFile/KeyFile and reloads it when the
+// files change
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads the certificate from files, the old one is kept on failure
+func (r *CertReloader) Reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate every interval if files are modified, until stop
+// is closed
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := r.filesModTime()
+		if err != nil {
+			Logger.Errorf("CertReloader stat %s error %v", r.certFile, err)
+			continue
+		}
+
+		r.mutex.RLock()
+		changed := modTime.After(r.modTime)
+		r.mutex.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			Logger.Errorf("CertReloader reload %s error %v", r.certFile, err)
+		} else {
+			Logger.Infof("CertReloader reloaded %s", r.certFile)
+		}
+	}
+}
+
+// NewTLSConfig builds the tls.Config of opts, the returned reloader is nil if
+// certificates are not loaded from files
+func NewTLSConfig(opts *TLSOptions) (*tls.Config, *CertReloader, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.Config != nil {
+		config = opts.Config.Clone()
+	}
+
+	var reloader *CertReloader
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		var err error
+		if reloader, err = NewCertReloader(opts.CertFile, opts.KeyFile); err != nil {
+			return nil, nil, err
+		}
+		config.Certificates = nil
+		config.GetCertificate = reloader.GetCertificate
+	}
+
+	if config.GetCertificate == nil && len(config.Certificates) == 0 {
+		return nil, nil, errors.New("kit:tls certificate is not configured")
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("kit:no certificate found in %s", opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	if opts.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if config.ClientCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// without a pool clients are verified against the system roots, any public
+	// certificate would become a PeerIdentity
+	if config.ClientAuth >= tls.VerifyClientCertIfGiven && config.ClientCAs == nil {
+		return nil, nil, errors.New("kit:client certificates are verified without ClientCAFile or Config.ClientCAs")
+	}
+	return config, reloader, nil
+}
+
+// RunWebSocketServerTLS is RunWebSocketServer over TLS
+func (s *Server) RunWebSocketServerTLS(path string, port int, opts *TLSOptions) {
+	config, reloader, err := NewTLSConfig(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	if reloader != nil && opts.ReloadInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go reloader.Watch(opts.ReloadInterval, stop)
+	}
+
+	mux := s.newServeMux(path)
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   mux,
+		TLSConfig: config,
+	}
+
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,136 @@
+package kit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate of cn and its key into dir
+func writeCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, r *CertReloader) string {
+	t.Helper()
+	cert, _ := r.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestNewTLSConfigClientVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir, "server")
+
+	if _, _, err := NewTLSConfig(&TLSOptions{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true}); err == nil {
+		t.Fatal("client certificates required without a CA pool")
+	}
+	base := &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven}
+	if _, _, err := NewTLSConfig(&TLSOptions{CertFile: certFile, KeyFile: keyFile, Config: base}); err == nil {
+		t.Fatal("client certificates verified by a base config without a CA pool")
+	}
+
+	config, _, err := NewTLSConfig(&TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile, RequireClientCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Fatalf("client auth %v", config.ClientAuth)
+	}
+
+	config, _, err = NewTLSConfig(&TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("client auth %v", config.ClientAuth)
+	}
+
+	config, _, err = NewTLSConfig(&TLSOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Fatalf("client auth %v", config.ClientAuth)
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir, "old")
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(20*time.Millisecond, stop)
+
+	// a broken file is not served
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	os.Chtimes(certFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if cn := servedCommonName(t, r); cn != "old" {
+		t.Fatalf("serving %s after a broken write", cn)
+	}
+
+	writeCert(t, dir, "new")
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	waitUntil(t, func() bool { return servedCommonName(t, r) == "new" })
+}
@@ -0,0 +1,147 @@
+package kit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const typeScriptClient = `export interface FieldError {
+  field: string;
+  rule: string;
+  message: string;
+}
+
+export interface ErrorResponse {
+  code: number;
+  error: string;
+  fields?: Array<FieldError>;
+}
+
+export function isErrorResponse(v: any): v is ErrorResponse {
+  return v != null && typeof v.code === "number" && typeof v.error === "string";
+}
+
+export interface KitSessionLike {
+  request(route: string, msg: any, cb: (data: any) => void): void;
+  notify(route: string, msg: any): void;
+  on(route: string, fn: (data: any) => void): any;
+  off(route: string, fn?: (data: any) => void): any;
+}
+
+export class TypedKitSession {
+  constructor(public readonly session: KitSessionLike) {}
+
+  request<R extends keyof RequestMap>(route: R, msg: RequestMap[R]["req"]): Promise<RequestMap[R]["resp"] | ErrorResponse> {
+    return new Promise((resolve) => this.session.request(route as string, msg, resolve));
+  }
+
+  notify<R extends keyof NotifyMap>(route: R, msg: NotifyMap[R]): void {
+    this.session.notify(route as string, msg);
+  }
+
+  on<R extends keyof PushMap>(route: R, fn: (data: PushMap[R]) => void): void {
+    this.session.on(route as string, fn);
+  }
+
+  off<R extends keyof PushMap>(route: R, fn?: (data: PushMap[R]) => void): void {
+    this.session.off(route as string, fn);
+  }
+}
+`
+
+// WriteTypeScript generates a typed wrapper of KitSession from schema
+func WriteTypeScript(w io.Writer, schema *Schema) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("// Code generated by kitgen. DO NOT EDIT.\n\n")
+
+	names := make([]string, 0, len(schema.Types))
+	for name := range schema.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(buf, "export interface %s %s\n\n", name, tsObject(schema.Types[name], ""))
+	}
+
+	buf.WriteString("export interface RequestMap {\n")
+	for _, r := range schema.Routes {
+		if r.Notify {
+			continue
+		}
+		resp := "unknown"
+		if r.Response != nil {
+			resp = tsType(r.Response, "  ")
+		}
+		fmt.Fprintf(buf, "  %s: { req: %s; resp: %s };\n", strconv.Quote(r.Route), tsType(r.Request, "  "), resp)
+	}
+	buf.WriteString("}\n\n")
+
+	buf.WriteString("export interface NotifyMap {\n")
+	for _, r := range schema.Routes {
+		if !r.Notify {
+			continue
+		}
+		fmt.Fprintf(buf, "  %s: %s;\n", strconv.Quote(r.Route), tsType(r.Request, "  "))
+	}
+	buf.WriteString("}\n\n")
+
+	buf.WriteString("export interface PushMap {\n")
+	for _, p := range schema.Pushes {
+		fmt.Fprintf(buf, "  %s: %s;\n", strconv.Quote(p.Route), tsType(p.Data, "  "))
+	}
+	buf.WriteString("}\n\n")
+
+	buf.WriteString(typeScriptClient)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func tsType(t *TypeSchema, indent string) string {
+	var s string
+	switch t.Kind {
+	case SchemaKindString, SchemaKindBytes:
+		s = "string"
+	case SchemaKindNumber:
+		s = "number"
+	case SchemaKindBoolean:
+		s = "boolean"
+	case SchemaKindArray:
+		s = "Array<" + tsType(t.Elem, indent) + ">"
+	case SchemaKindMap:
+		s = "{ [key: string]: " + tsType(t.Elem, indent) + " }"
+	case SchemaKindObject:
+		s = tsObject(t, indent)
+	case SchemaKindRef:
+		s = t.Ref
+	default:
+		s = "any"
+	}
+
+	if t.Nullable {
+		s += " | null"
+	}
+	return s
+}
+
+func tsObject(t *TypeSchema, indent string) string {
+	if len(t.Fields) == 0 {
+		return "{}"
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("{\n")
+	for _, f := range t.Fields {
+		optional := ""
+		if f.Optional {
+			optional = "?"
+		}
+		fmt.Fprintf(buf, "%s  %s%s: %s;\n", indent, strconv.Quote(f.Name), optional, tsType(f.Type, indent+"  "))
+	}
+	buf.WriteString(indent + "}")
+	return buf.String()
+}
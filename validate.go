@@ -0,0 +1,299 @@
+package kit
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Validator could be implemented by request types for checks which can not be
+// expressed by `validate` struct tags, it runs after the tags passed
+type Validator interface {
+	Validate() error
+}
+
+// FieldError describes one invalid field, Field is the json path like items[0].name
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned by validation, Validate() could return it to report
+// field level errors
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+type fieldRule struct {
+	name  string
+	arg   string
+	num   float64
+	oneof []string
+}
+
+type fieldValidator struct {
+	index    int
+	name     string // json name
+	embedded bool   // fields are promoted to the parent
+	rules    []fieldRule
+	nested   *structValidator // struct, *struct or []struct
+}
+
+type structValidator struct {
+	fields []*fieldValidator
+}
+
+var (
+	structValidators      = make(map[reflect.Type]*structValidator)
+	structValidatorsMutex sync.Mutex
+)
+
+// compileValidator parses the `validate` tags of t, it panics on invalid tags so
+// mistakes are found by Route.Reg
+func compileValidator(t reflect.Type) *structValidator {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	structValidatorsMutex.Lock()
+	defer structValidatorsMutex.Unlock()
+	return compileValidatorLocked(t)
+}
+
+func compileValidatorLocked(t reflect.Type) *structValidator {
+	if v, ok := structValidators[t]; ok {
+		return v
+	}
+
+	v := &structValidator{}
+	// register before walking fields for recursive types, and forget it if a tag
+	// panics, so registering it again panics too
+	structValidators[t] = v
+	compiled := false
+	defer func() {
+		if !compiled {
+			delete(structValidators, t)
+		}
+	}()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		fv := &fieldValidator{index: i, name: jsonFieldName(f)}
+		fv.embedded = f.Anonymous && fv.name == f.Name
+
+		if tag := f.Tag.Get("validate"); tag != "" {
+			for _, r := range strings.Split(tag, ",") {
+				fv.rules = append(fv.rules, parseFieldRule(t, f, r))
+			}
+		}
+
+		et := f.Type
+		for et.Kind() == reflect.Ptr || et.Kind() == reflect.Slice || et.Kind() == reflect.Array {
+			et = et.Elem()
+		}
+		if et.Kind() == reflect.Struct {
+			if nested := compileValidatorLocked(et); len(nested.fields) > 0 {
+				fv.nested = nested
+			}
+		}
+
+		if len(fv.rules) > 0 || fv.nested != nil {
+			v.fields = append(v.fields, fv)
+		}
+	}
+	compiled = true
+	return v
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if idx := strings.Index(tag, ","); idx >= 0 {
+		tag = tag[:idx]
+	}
+	if tag == "" || tag == "-" {
+		return f.Name
+	}
+	return tag
+}
+
+func parseFieldRule(t reflect.Type, f reflect.StructField, s string) fieldRule {
+	r := fieldRule{name: strings.TrimSpace(s)}
+	if idx := strings.Index(r.name, "="); idx >= 0 {
+		r.name, r.arg = r.name[:idx], r.name[idx+1:]
+	}
+
+	switch r.name {
+	case "required":
+	case "min", "max", "len":
+		n, err := strconv.ParseFloat(r.arg, 64)
+		if err != nil {
+			panic(fmt.Errorf("%s.%s invalid validate rule %s", t.Name(), f.Name, s))
+		}
+		r.num = n
+	case "oneof":
+		r.oneof = strings.Fields(r.arg)
+	default:
+		panic(fmt.Errorf("%s.%s unknown validate rule %s", t.Name(), f.Name, s))
+	}
+	return r
+}
+
+// validate runs struct tags and Validator of v
+func validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	sv := compileValidator(rv.Type())
+
+	var fields []FieldError
+	if sv != nil {
+		fields = sv.check(reflect.Indirect(rv), "", fields)
+	}
+
+	if len(fields) == 0 {
+		if validator, ok := v.(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				var ve *ValidationError
+				if errors.As(err, &ve) {
+					// a typed nil is not nil as error
+					if ve == nil {
+						return nil
+					}
+					return ve
+				}
+				return &ValidationError{Fields: []FieldError{{Rule: "custom", Message: err.Error()}}}
+			}
+		}
+		return nil
+	}
+	return &ValidationError{Fields: fields}
+}
+
+func (sv *structValidator) check(v reflect.Value, prefix string, errs []FieldError) []FieldError {
+	for _, fv := range sv.fields {
+		field := prefix + fv.name
+		value := v.Field(fv.index)
+
+		failed := false
+		for _, r := range fv.rules {
+			if msg := r.check(value); msg != "" {
+				errs = append(errs, FieldError{Field: field, Rule: r.name, Message: msg})
+				failed = true
+				break
+			}
+		}
+
+		if !failed && fv.nested != nil {
+			errs = fv.checkNested(value, field, errs)
+		}
+	}
+	return errs
+}
+
+func (fv *fieldValidator) checkNested(v reflect.Value, field string, errs []FieldError) []FieldError {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return errs
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if fv.embedded {
+			return fv.nested.check(v, strings.TrimSuffix(field, fv.name), errs)
+		}
+		return fv.nested.check(v, field+".", errs)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			errs = fv.checkNested(v.Index(i), fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	}
+	return errs
+}
+
+// check returns an error message, empty means valid
+func (r *fieldRule) check(v reflect.Value) string {
+	if r.name == "required" {
+		if v.IsZero() {
+			return "is required"
+		}
+		return ""
+	}
+
+	for v.Kind() == reflect.Ptr {
+		// optional field which is absent
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	var n float64
+	var unit string
+	switch v.Kind() {
+	case reflect.String:
+		if r.name == "oneof" {
+			for _, o := range r.oneof {
+				if v.String() == o {
+					return ""
+				}
+			}
+			return "must be one of " + strings.Join(r.oneof, ", ")
+		}
+		n, unit = float64(utf8.RuneCountInString(v.String())), "length"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		n, unit = float64(v.Len()), "length"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, unit = float64(v.Int()), "value"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, unit = float64(v.Uint()), "value"
+	case reflect.Float32, reflect.Float64:
+		n, unit = v.Float(), "value"
+	default:
+		return ""
+	}
+
+	if r.name == "oneof" {
+		for _, o := range r.oneof {
+			if strconv.FormatFloat(n, 'f', -1, 64) == o {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(r.oneof, ", ")
+	}
+
+	switch r.name {
+	case "min":
+		if n < r.num {
+			return fmt.Sprintf("%s must be at least %s", unit, r.arg)
+		}
+	case "max":
+		if n > r.num {
+			return fmt.Sprintf("%s must be at most %s", unit, r.arg)
+		}
+	case "len":
+		if n != r.num {
+			return fmt.Sprintf("%s must be %s", unit, r.arg)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package kit
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type TypedNilReq struct {
+	RequestHead
+}
+
+func (r *TypedNilReq) Validate() error {
+	var ve *ValidationError
+	return ve
+}
+
+type TypedNil struct{}
+
+func (h *TypedNil) Check(s *Session, r *TypedNilReq) {
+	s.Response(r, struct{}{})
+}
+
+func TestValidateTypedNil(t *testing.T) {
+	if err := validate(&TypedNilReq{}); err != nil {
+		t.Fatalf("typed nil ValidationError returned %v", err)
+	}
+
+	route := NewRoute()
+	route.Reg("test", &TypedNil{})
+	c := dialTest(t, NewServer(route), nil, true)
+	defer c.conn.Close()
+	if code := c.requestCode(1, "test.check", &TypedNilReq{}); code != CodeOK {
+		t.Fatalf("request got %d", code)
+	}
+}
+
+type ValidItem struct {
+	Name string `json:"name" validate:"required,max=5"`
+}
+
+type ValidProfile struct {
+	Nick string `json:"nick" validate:"min=2"`
+}
+
+type ValidReq struct {
+	RequestHead
+	ValidProfile
+	Name  string      `json:"name" validate:"required,min=2,max=4"`
+	Code  string      `json:"code" validate:"len=3"`
+	Color string      `json:"color" validate:"oneof=red green"`
+	Age   int         `json:"age" validate:"required,min=1,max=120"`
+	Level int         `json:"level" validate:"oneof=1 2 3"`
+	Score float64     `json:"score" validate:"max=1.5"`
+	Tags  []string    `json:"tags" validate:"required,max=2"`
+	Pair  []int       `json:"pair" validate:"len=2"`
+	Items []ValidItem `json:"items"`
+	Owner *ValidItem  `json:"owner"`
+	Limit *int        `json:"limit" validate:"min=5"`
+}
+
+func validReq() *ValidReq {
+	return &ValidReq{
+		ValidProfile: ValidProfile{Nick: "bo"},
+		Name:         "kit",
+		Code:         "abc",
+		Color:        "red",
+		Age:          30,
+		Level:        2,
+		Score:        1,
+		Tags:         []string{"a"},
+		Pair:         []int{1, 2},
+		Items:        []ValidItem{{Name: "x"}},
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	limit := 3
+	cases := []struct {
+		name  string
+		edit  func(r *ValidReq)
+		field string // empty means valid
+		rule  string
+	}{
+		{"valid", func(r *ValidReq) {}, "", ""},
+		{"required string", func(r *ValidReq) { r.Name = "" }, "name", "required"},
+		{"min string", func(r *ValidReq) { r.Name = "k" }, "name", "min"},
+		{"max string counts runes", func(r *ValidReq) { r.Name = "四个汉字" }, "", ""},
+		{"max string", func(r *ValidReq) { r.Name = "kitty" }, "name", "max"},
+		{"len string", func(r *ValidReq) { r.Code = "ab" }, "code", "len"},
+		{"oneof string", func(r *ValidReq) { r.Color = "blue" }, "color", "oneof"},
+		{"required number", func(r *ValidReq) { r.Age = 0 }, "age", "required"},
+		{"max number", func(r *ValidReq) { r.Age = 121 }, "age", "max"},
+		{"min number", func(r *ValidReq) { r.Age = -1 }, "age", "min"},
+		{"oneof number", func(r *ValidReq) { r.Level = 4 }, "level", "oneof"},
+		{"max float", func(r *ValidReq) { r.Score = 1.6 }, "score", "max"},
+		{"required slice", func(r *ValidReq) { r.Tags = nil }, "tags", "required"},
+		{"max slice", func(r *ValidReq) { r.Tags = []string{"a", "b", "c"} }, "tags", "max"},
+		{"len slice", func(r *ValidReq) { r.Pair = []int{1} }, "pair", "len"},
+		{"absent pointer", func(r *ValidReq) { r.Limit = nil }, "", ""},
+		{"min pointer", func(r *ValidReq) { r.Limit = &limit }, "limit", "min"},
+		{"nested slice", func(r *ValidReq) { r.Items = append(r.Items, ValidItem{}) }, "items[1].name", "required"},
+		{"nested pointer", func(r *ValidReq) { r.Owner = &ValidItem{Name: "toolong"} }, "owner.name", "max"},
+		{"promoted embedded", func(r *ValidReq) { r.Nick = "b" }, "nick", "min"},
+	}
+
+	for _, tc := range cases {
+		r := validReq()
+		tc.edit(r)
+		err := validate(r)
+		if tc.field == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+
+		ve, ok := err.(*ValidationError)
+		if !ok || len(ve.Fields) != 1 {
+			t.Errorf("%s: got %v", tc.name, err)
+			continue
+		}
+		if f := ve.Fields[0]; f.Field != tc.field || f.Rule != tc.rule {
+			t.Errorf("%s: got %s %s, want %s %s", tc.name, f.Field, f.Rule, tc.field, tc.rule)
+		}
+	}
+}
+
+type CustomReq struct {
+	Name string `json:"name" validate:"required"`
+	err  error
+	runs int
+}
+
+func (r *CustomReq) Validate() error {
+	r.runs++
+	return r.err
+}
+
+func TestValidator(t *testing.T) {
+	fields := &ValidationError{Fields: []FieldError{{Field: "name", Rule: "taken", Message: "is taken"}}}
+	cases := []struct {
+		name string
+		req  *CustomReq
+		want []FieldError
+		runs int
+	}{
+		{"passed", &CustomReq{Name: "a"}, nil, 1},
+		{"plain error", &CustomReq{Name: "a", err: errors.New("bad")}, []FieldError{{Rule: "custom", Message: "bad"}}, 1},
+		{"field errors", &CustomReq{Name: "a", err: fields}, fields.Fields, 1},
+		{"wrapped field errors", &CustomReq{Name: "a", err: fmt.Errorf("wrap: %w", fields)}, fields.Fields, 1},
+		{"tags failed first", &CustomReq{err: errors.New("bad")}, []FieldError{{Field: "name", Rule: "required", Message: "is required"}}, 0},
+	}
+
+	for _, tc := range cases {
+		err := validate(tc.req)
+		if tc.req.runs != tc.runs {
+			t.Errorf("%s: Validate ran %d times", tc.name, tc.req.runs)
+		}
+		if tc.want == nil {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		ve, ok := err.(*ValidationError)
+		if !ok || !reflect.DeepEqual(ve.Fields, tc.want) {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+type UnknownRuleReq struct {
+	Name string `validate:"email"`
+}
+
+type BadNumberReq struct {
+	Age int `validate:"min=ten"`
+}
+
+type BadNestedReq struct {
+	Items []BadNumberReq
+}
+
+type UnknownRule struct{}
+
+func (h *UnknownRule) Do(s *Session, r *UnknownRuleReq) {}
+
+type BadNumber struct{}
+
+func (h *BadNumber) Do(s *Session, r *BadNumberReq) {}
+
+type BadNested struct{}
+
+func (h *BadNested) Do(s *Session, r *BadNestedReq) {}
+
+func TestRegPanicsOnInvalidRules(t *testing.T) {
+	for _, h := range []interface{}{&UnknownRule{}, &BadNumber{}, &BadNested{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Reg(%T) did not panic", h)
+				}
+			}()
+			NewRoute().Reg("test", h)
+		}()
+	}
+}
+
+func TestRegPanicsAgainOnInvalidRules(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Reg #%d did not panic", i)
+				}
+			}()
+			NewRoute().Reg("test", &BadNumber{})
+		}()
+	}
+}
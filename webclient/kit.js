@@ -18,6 +18,17 @@
         WebSocket = require('wxwebsocket.js');
     }
 
+    var LongPollSocket = null;
+    if (Global && Global.LongPollSocket) {
+        LongPollSocket = Global.LongPollSocket;
+    } else if (typeof XMLHttpRequest !== 'undefined') {
+        try {
+            LongPollSocket = require('longpoll.js');
+        } catch (e) {
+            LongPollSocket = null;
+        }
+    }
+
     function Emitter(obj) {
         if (obj) return mixin(obj);
     }
@@ -174,6 +185,115 @@
 
     var reqId = 0;
 
+    var subtle = null;
+    if (Global && Global.crypto && Global.crypto.subtle) {
+        subtle = Global.crypto.subtle;
+    }
+
+    var CapabilityEncryption = 'e2e.p256.aesgcm';
+    var encryptionSignContext = Protocol.strencode('kit e2e v1');
+
+    function encodeBase64(bytes) {
+        var str = '';
+        for (var i = 0; i < bytes.length; i++) {
+            str += String.fromCharCode(bytes[i]);
+        }
+        return btoa(str);
+    }
+
+    function decodeBase64(str) {
+        var bin = atob(str || '');
+        var bytes = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            bytes[i] = bin.charCodeAt(i);
+        }
+        return bytes;
+    }
+
+    function concatBytes(a, b) {
+        var out = new Uint8Array(a.length + b.length);
+        out.set(a, 0);
+        out.set(b, a.length);
+        return out;
+    }
+
+    // nonces are the packet counters of each direction, see encryption.go
+    function packetNonce(seq) {
+        var nonce = new Uint8Array(12);
+        for (var i = 11; i >= 4 && seq > 0; i--) {
+            nonce[i] = seq % 256;
+            seq = Math.floor(seq / 256);
+        }
+        return nonce;
+    }
+
+    /**
+     * PacketCipher seals and opens data packet bodies, calls must follow the
+     * wire order.
+     */
+    function PacketCipher(send, recv) {
+        this.send = send;
+        this.recv = recv;
+        this.sendSeq = 0;
+        this.recvSeq = 0;
+    }
+
+    PacketCipher.prototype.seal = function(data) {
+        var iv = packetNonce(this.sendSeq++);
+        return subtle.encrypt({name: 'AES-GCM', iv: iv}, this.send, data).then(function(b) {
+            return new Uint8Array(b);
+        });
+    };
+
+    PacketCipher.prototype.open = function(data) {
+        var iv = packetNonce(this.recvSeq++);
+        return subtle.decrypt({name: 'AES-GCM', iv: iv}, this.recv, data).then(function(b) {
+            return new Uint8Array(b);
+        });
+    };
+
+    function newKeyPair() {
+        return subtle.generateKey({name: 'ECDH', namedCurve: 'P-256'}, false, ['deriveBits']).then(function(pair) {
+            return subtle.exportKey('raw', pair.publicKey).then(function(raw) {
+                return {pair: pair, raw: new Uint8Array(raw)};
+            });
+        });
+    }
+
+    /**
+     * newPacketCipher verifies the server key is signed by the pinned key, then
+     * derives the keys of both directions.
+     */
+    function newPacketCipher(keys, pinned, serverKeyBase64, sigBase64) {
+        var serverKey = decodeBase64(serverKeyBase64);
+        var signed = concatBytes(concatBytes(encryptionSignContext, keys.raw), serverKey);
+
+        return subtle.importKey('raw', decodeBase64(pinned), {name: 'ECDSA', namedCurve: 'P-256'}, false, ['verify']).then(function(pin) {
+            return subtle.verify({name: 'ECDSA', hash: 'SHA-256'}, pin, decodeBase64(sigBase64), signed);
+        }).then(function(ok) {
+            if (!ok) {
+                throw new Error('server key is not signed by the pinned key');
+            }
+            return subtle.importKey('raw', serverKey, {name: 'ECDH', namedCurve: 'P-256'}, false, []);
+        }).then(function(pub) {
+            return subtle.deriveBits({name: 'ECDH', public: pub}, keys.pair.privateKey, 256);
+        }).then(function(secret) {
+            return subtle.importKey('raw', secret, 'HKDF', false, ['deriveKey']);
+        }).then(function(hkdf) {
+            var salt = concatBytes(keys.raw, serverKey);
+            function derive(info, usage) {
+                return subtle.deriveKey({name: 'HKDF', hash: 'SHA-256', salt: salt, info: Protocol.strencode(info)},
+                    hkdf, {name: 'AES-GCM', length: 256}, false, [usage]);
+            }
+            return Promise.all([
+                derive('kit e2e client to server', 'encrypt'),
+                derive('kit e2e server to client', 'decrypt')
+            ]);
+        }).then(function(aes) {
+            return new PacketCipher(aes[0], aes[1]);
+        });
+    }
+
     function KitSession(params, cb) {
         var self = this;
 
@@ -185,8 +305,15 @@
             throw new Error('params.url is needed');
         }
 
-        self.sid = ''; //session id
+        self.token = ''; // resume token, valid for the next reconnect only
+        self.protocolVersion = KitSession.ProtocolVersion;
+        self.capabilities = []; // negotiated in handshake
+        self._caps = params.capabilities || [];
         self.url = params.url;
+        // long poll fallback, served by Server at <websocket path>/poll
+        self.pollUrl = params.pollUrl || params.url.replace(/^ws/, 'http').replace(/\/$/, '') + '/poll';
+        self._usePoll = !!params.forcePoll || !WebSocket;
+        self._wsOpened = false;
         self.log = params.log;
         self._readyCb = cb;
 
@@ -194,12 +321,21 @@
         self._heartbeatTimer = null;
 
         self._requestCallbacks = {};
+        self._requestHandlers = {};
         self._delayBuffer = [];
         self._reconnectMaxAttempts = params.reconnectMaxAttempts || 10;
         self._reconnectDelay = params.reconnectDelay || 2;
         self._reconnectAttempts = 0;
         self._reconnectTimer = null;
 
+        // {serverKey: base64 public key of Server.EncryptionKey, optional: false},
+        // the handshake fails unless encrypted with a key signed by serverKey,
+        // set optional to accept servers not offering encryption
+        self._encryption = params.encryption || null;
+        self._cipher = null;
+        self._cryptoChain = null; // keeps async sealing and opening in wire order
+        self._keys = null;
+
         self._connect();
     }
 
@@ -210,6 +346,9 @@
     KitSession.Closed = 'closed';
     KitSession.Closing  = 'closing';
 
+    KitSession.ProtocolVersion = 1;
+    KitSession.CapabilityEncryption = CapabilityEncryption;
+
     KitSession.prototype.notify = function(route, msg) {
         var self = this;
         msg = msg || {};
@@ -237,6 +376,14 @@
         }
     };
 
+    /**
+     * Handle requests sent by server, fn(body, reply) should call reply(data) once.
+     */
+    KitSession.prototype.handle = function(route, fn) {
+        var self = this;
+        self._requestHandlers[route] = fn;
+    };
+
     KitSession.prototype.disconnect = function() {
         var self = this;
         if (self.state == KitSession.Closing
@@ -260,13 +407,55 @@
         var self = this;
         var type = reqId ? Message.TYPE_REQUEST : Message.TYPE_NOTIFY;
         msg = Protocol.strencode(JSON.stringify(msg));
-        msg = Message.encode(reqId, type, 0, route, msg);
-        var packet = Package.encode(Package.TYPE_DATA, msg);
+        self._sendData(Message.encode(reqId, type, 0, route, msg));
+    };
+
+    KitSession.prototype._sendResponse = function(id, msg) {
+        var self = this;
+        msg = Protocol.strencode(JSON.stringify(msg === undefined ? {} : msg));
+        self._sendData(Message.encode(id, Message.TYPE_RESPONSE, 0, null, msg));
+    };
+
+    // messages are buffered until the handshake is done, they are encrypted
+    // with the keys of the connection they are finally sent on
+    KitSession.prototype._sendData = function(msg) {
+        var self = this;
         if (self.state === KitSession.Open) {
-            self._send(packet);
+            self._writeData(msg);
         } else {
-            self._delayBuffer.push(packet);
+            self._delayBuffer.push(msg);
+        }
+    };
+
+    KitSession.prototype._writeData = function(msg) {
+        var self = this;
+        var cipher = self._cipher;
+        if (!cipher) {
+            self._send(Package.encode(Package.TYPE_DATA, msg));
+            return;
         }
+
+        var socket = self.socket;
+        self._crypto(function() {
+            return cipher.seal(msg).then(function(body) {
+                if (self.socket === socket) {
+                    self._send(Package.encode(Package.TYPE_DATA, body));
+                }
+            });
+        });
+    };
+
+    // _crypto runs fn after the previous crypto work, a failure drops the
+    // connection as the packet counters are out of sync
+    KitSession.prototype._crypto = function(fn) {
+        var self = this;
+        var socket = self.socket;
+        self._cryptoChain = self._cryptoChain.then(fn).catch(function(err) {
+            self.log && console.error('packet crypto failed', err);
+            if (self.socket === socket) {
+                socket.close();
+            }
+        });
     };
 
     KitSession.prototype._close = function() {
@@ -322,7 +511,19 @@
                 self._onHeartbeat(pkt.body);
                 break;
             case Package.TYPE_DATA:
-                self._onData(pkt.body);
+                if (self._cipher) {
+                    var cipher = self._cipher;
+                    var socket = self.socket;
+                    self._crypto(function() {
+                        return cipher.open(pkt.body).then(function(plain) {
+                            if (self.socket === socket) {
+                                self._onData(plain);
+                            }
+                        });
+                    });
+                } else {
+                    self._onData(pkt.body);
+                }
                 break;
             case Package.TYPE_KICK:
                 self._onKick(pkt.body);
@@ -335,7 +536,12 @@
         msg = Message.decode(msg);
         msg.body = JSON.parse(Protocol.strdecode(msg.body));
 
-        if (!msg.id) {
+        if (msg.type === Message.TYPE_REQUEST) {
+            self._onRequest(msg);
+            return;
+        }
+
+        if (msg.type !== Message.TYPE_RESPONSE) {
             self.emit(msg.route, msg.body);
             return;
         }
@@ -347,6 +553,25 @@
         delete(self._requestCallbacks[msg.id]);
     };
 
+    KitSession.prototype._onRequest = function(msg) {
+        var self = this;
+        var fn = self._requestHandlers[msg.route];
+        if (!fn) {
+            self.log && console.error('unhandled server request', msg.route);
+            self._sendResponse(msg.id, {code: 404, error: 'unhandled route ' + msg.route});
+            return;
+        }
+
+        var replied = false;
+        fn(msg.body, function(data) {
+            if (replied) {
+                return;
+            }
+            replied = true;
+            self._sendResponse(msg.id, data);
+        });
+    };
+
     KitSession.prototype._onKick = function(msg) {
         var self = this;
         self.log && console.log('session closed by server');
@@ -375,18 +600,67 @@
         }
     };
 
+    // _rejectHandshake closes without reconnecting
+    KitSession.prototype._rejectHandshake = function(msg) {
+        var self = this;
+        self.log && console.error('handshake rejected', msg);
+        self._close();
+        self.emit('error', msg);
+    };
+
     KitSession.prototype._onHandshake = function(msg) {
         var self = this;
-        self.state = KitSession.Open;
 
         msg = JSON.parse(Protocol.strdecode(msg));
         self.log && console.log('onHandshake', msg);
 
-        if (msg.sid) {
-            self.sid = msg.sid;
-            self.log && console.log('sid', self.sid);
+        if (msg.code && msg.code !== 200) {
+            // rejected, e.g. 505 protocol version not supported, do not reconnect
+            self._rejectHandshake(msg);
+            return;
+        }
+
+        var encrypted = (msg.caps || []).indexOf(CapabilityEncryption) >= 0;
+        var encryption = self._encryption;
+        if (!encrypted) {
+            // a proxy could strip the capability, never fall back silently
+            if (encryption && !encryption.optional) {
+                self._rejectHandshake({code: 426, error: 'encryption not negotiated'});
+                return;
+            }
+            self._handshakeDone(msg);
+            return;
+        }
+
+        if (!encryption || !self._keys) {
+            self._rejectHandshake({code: 400, error: 'encryption not requested'});
+            return;
+        }
+
+        var socket = self.socket;
+        self._cryptoChain = newPacketCipher(self._keys, encryption.serverKey, msg.key, msg.sig).then(function(cipher) {
+            if (self.socket === socket) {
+                self._cipher = cipher;
+                self._handshakeDone(msg);
+            }
+        }, function(err) {
+            if (self.socket === socket) {
+                self._rejectHandshake({code: 400, error: String(err && err.message || err)});
+            }
+        });
+    };
+
+    KitSession.prototype._handshakeDone = function(msg) {
+        var self = this;
+        self.state = KitSession.Open;
+
+        self.protocolVersion = msg.ver || 1;
+        self.capabilities = msg.caps || [];
+
+        if (msg.token) {
+            self.token = msg.token;
         } else {
-            self.log && console.error('can\'t find sid')
+            self.log && console.error('can\'t find resume token')
         }
 
         if (msg.hb) {
@@ -399,7 +673,7 @@
 
         if (self._delayBuffer) {
             self._delayBuffer.forEach(function(msg) {
-                self._send(msg);
+                self._writeData(msg);
             });
             self._delayBuffer = [];
         }
@@ -413,17 +687,57 @@
         }
     };
 
+    KitSession.prototype.hasCapability = function(name) {
+        return this.capabilities.indexOf(name) >= 0;
+    };
+
     KitSession.prototype._connect = function() {
         var self = this;
         self.state = KitSession.Connecting
-
-        var socket = self.socket = new WebSocket(this.url);
+        self._cipher = null;
+        self._cryptoChain = Promise.resolve();
+        self._keys = null;
+
+        var socket;
+        if (self._usePoll) {
+            self.log && console.log('connect with long poll', self.pollUrl);
+            socket = self.socket = new LongPollSocket(self.pollUrl);
+        } else {
+            socket = self.socket = new WebSocket(self.url);
+        }
         socket.binaryType = 'arraybuffer';
 
         socket.onopen = function(e) {
-            var req = {sid:self.sid};
-            var obj = Package.encode(Package.TYPE_HANDSHAKE, Protocol.strencode(JSON.stringify(req)));
-            self._send(obj);
+            if (!self._usePoll) {
+                self._wsOpened = true;
+            }
+            var req = {token:self.token, ver:KitSession.ProtocolVersion, caps:self._caps.slice()};
+            function handshake() {
+                var obj = Package.encode(Package.TYPE_HANDSHAKE, Protocol.strencode(JSON.stringify(req)));
+                self._send(obj);
+            }
+
+            if (!self._encryption) {
+                handshake();
+                return;
+            }
+            if (!subtle) {
+                self._rejectHandshake({code: 400, error: 'encryption needs WebCrypto'});
+                return;
+            }
+
+            // a new key pair for every connection
+            newKeyPair().then(function(keys) {
+                if (self.socket !== socket) {
+                    return;
+                }
+                self._keys = keys;
+                req.caps.push(CapabilityEncryption);
+                req.key = encodeBase64(keys.raw);
+                handshake();
+            }, function(err) {
+                self._rejectHandshake({code: 400, error: String(err && err.message || err)});
+            });
         };
 
         function reconnect(e) {
@@ -434,6 +748,14 @@
             self.log && console.error(e);
             self._close();
 
+            // websocket never worked, maybe blocked by proxy
+            if (!self._usePoll && !self._wsOpened && LongPollSocket) {
+                self.log && console.log('websocket failed, fallback to long poll');
+                self._usePoll = true;
+                self._connect();
+                return;
+            }
+
             if (self._reconnectMaxAttempts > self._reconnectAttempts) {
                 if (self._reconnectTimer) {
                     clearTimeout(self._reconnectTimer);
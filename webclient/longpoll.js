@@ -0,0 +1,152 @@
+(function() {
+    var Global = null;
+    if (typeof window !== "undefined") {
+       Global = window;
+    }
+
+    var RETRY_DELAY = 1000; // ms before sending a POST rejected with 429 again
+
+    // the cid is sent in this header instead of the url, see LongPollIdHeader
+    var ID_HEADER = 'X-Kit-Poll-Id';
+
+    function request(method, url, cid, body, cb) {
+        var xhr = new XMLHttpRequest();
+        xhr.open(method, url, true);
+        xhr.responseType = 'arraybuffer';
+        if (cid) {
+            xhr.setRequestHeader(ID_HEADER, cid);
+        }
+        xhr.onload = function() {
+            if (xhr.status >= 200 && xhr.status < 300) {
+                cb(null, xhr);
+            } else {
+                cb(new Error(method + ' ' + url + ' status ' + xhr.status), xhr);
+            }
+        };
+        xhr.onerror = function() {
+            cb(new Error(method + ' ' + url + ' network error'), xhr);
+        };
+        xhr.send(body);
+        return xhr;
+    }
+
+    function decodeJSON(buffer) {
+        var bytes = new Uint8Array(buffer);
+        var str = '';
+        for (var i = 0; i < bytes.length; i++) {
+            str += String.fromCharCode(bytes[i]);
+        }
+        return JSON.parse(str);
+    }
+
+    /**
+     * LongPollSocket has the same interface as WebSocket used by KitSession,
+     * packets are sent by POST and received by long-held GET.
+     */
+    function LongPollSocket(url) {
+        var self = this;
+        self.url = url;
+        self.cid = null;
+        self.closed = false;
+        self._sendQueue = [];
+        self._sending = false;
+        self._pollXhr = null;
+
+        request('POST', url, null, null, function(err, xhr) {
+            if (self.closed) {
+                return;
+            }
+            if (err) {
+                self._fail(err);
+                return;
+            }
+            self.cid = decodeJSON(xhr.response).cid;
+            self.onopen && self.onopen();
+            self._poll();
+        });
+    }
+
+    LongPollSocket.prototype._fail = function(err) {
+        var self = this;
+        if (self.closed) {
+            return;
+        }
+        self.closed = true;
+        self.onerror && self.onerror(err);
+        self.onclose && self.onclose();
+    };
+
+    LongPollSocket.prototype._poll = function() {
+        var self = this;
+        self._pollXhr = request('GET', self.url, self.cid, null, function(err, xhr) {
+            self._pollXhr = null;
+            if (self.closed) {
+                return;
+            }
+            if (err) {
+                self._fail(err);
+                return;
+            }
+            if (xhr.response && xhr.response.byteLength > 0) {
+                self.onmessage && self.onmessage({data: xhr.response});
+            }
+            self._poll();
+        });
+    };
+
+    // packets must arrive in order, so only one POST is in flight
+    LongPollSocket.prototype._flush = function() {
+        var self = this;
+        if (self._sending || self.closed || !self._sendQueue.length) {
+            return;
+        }
+        self._sending = true;
+        var data = self._sendQueue[0];
+        request('POST', self.url, self.cid, data, function(err, xhr) {
+            if (err && xhr.status === 429) {
+                // the server has not read earlier packets yet, send it again later
+                setTimeout(function() {
+                    self._sending = false;
+                    self._flush();
+                }, RETRY_DELAY);
+                return;
+            }
+            self._sending = false;
+            if (err) {
+                self._fail(err);
+                return;
+            }
+            self._sendQueue.shift();
+            self._flush();
+        });
+    };
+
+    LongPollSocket.prototype.send = function(data) {
+        var self = this;
+        self._sendQueue.push(data);
+        self._flush();
+    };
+
+    LongPollSocket.prototype.close = function() {
+        var self = this;
+        if (self.closed) {
+            return;
+        }
+        self.closed = true;
+        if (self._pollXhr) {
+            self._pollXhr.abort();
+            self._pollXhr = null;
+        }
+        if (self.cid) {
+            request('DELETE', self.url, self.cid, null, function() {});
+        }
+    };
+
+    if (Global) {
+        Global.LongPollSocket = LongPollSocket;
+    }
+
+    if (typeof module !== 'undefined') {
+        module.exports = LongPollSocket;
+    }
+})();
@@ -0,0 +1,304 @@
+(function() {
+    var Global = null;
+    if (typeof window !== "undefined") {
+       Global = window;
+    }
+
+    var Protocol;
+    if (Global && Global.Protocol) {
+        Protocol = Global.Protocol;
+    } else {
+        Protocol = require('protocol.js');
+    }
+
+    var Message = Protocol.Message;
+
+    // resume tokens are sent in this header instead of the url, see SSETokenHeader
+    var TOKEN_HEADER = 'X-Kit-Token';
+
+    function decodeBase64(str) {
+        var bin = atob(str);
+        var bytes = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            bytes[i] = bin.charCodeAt(i);
+        }
+        return bytes;
+    }
+
+    /**
+     * KitSSE is the client of Server.ServeSSE for push-only clients, pushes are
+     * received as server-sent events and requests are sent by POST. Every request
+     * consumes the resume token and gets the next one, so they are sent one by
+     * one. The server must be of the same origin, the token header is not exposed
+     * to other origins.
+     *
+     * var sse = new KitSSE({url: 'http://host/kit/sse'}, function() {...});
+     * sse.on('chat', function(data) {...});
+     * sse.request('chat.send', {text: 'hi'}, function(resp) {...});
+     */
+    function KitSSE(params, cb) {
+        var self = this;
+        if (typeof params === 'string') {
+            params = {url: params};
+        }
+        if (!params.url) {
+            throw new Error('params.url is needed');
+        }
+
+        self.url = params.url;
+        self.token = ''; // resume token, rotated by every subscription and request
+        self.closed = false;
+        self.log = params.log;
+        self._readyCb = cb;
+        self._handlers = {};
+        self._reconnectDelay = params.reconnectDelay || 2;
+        self._reconnectMaxAttempts = params.reconnectMaxAttempts || 10;
+        self._reconnectAttempts = 0;
+        self._abort = null;
+        self._tokenQueue = []; // functions waiting for the token
+        self._tokenBusy = false;
+
+        self._subscribe();
+    }
+
+    // _withToken runs fn(token, release) after the previous user of the token
+    // called release(nextToken), nextToken is kept if given
+    KitSSE.prototype._withToken = function(fn) {
+        var self = this;
+        self._tokenQueue.push(fn);
+        self._nextToken();
+    };
+
+    KitSSE.prototype._nextToken = function() {
+        var self = this;
+        if (self._tokenBusy || !self._tokenQueue.length) {
+            return;
+        }
+        self._tokenBusy = true;
+        var fn = self._tokenQueue.shift();
+        var released = false;
+        fn(self.token, function(next) {
+            if (released) {
+                return;
+            }
+            released = true;
+            if (next) {
+                self.token = next;
+            }
+            self._tokenBusy = false;
+            self._nextToken();
+        });
+    };
+
+    /**
+     * Listen on pushes of route, 'close' is emitted when the session is closed.
+     */
+    KitSSE.prototype.on = function(route, fn) {
+        var self = this;
+        (self._handlers[route] = self._handlers[route] || []).push(fn);
+    };
+
+    KitSSE.prototype._emit = function(route, data) {
+        var self = this;
+        var fns = self._handlers[route] || [];
+        for (var i = 0; i < fns.length; i++) {
+            fns[i](data);
+        }
+    };
+
+    KitSSE.prototype._endpoint = function(query) {
+        var self = this;
+        var sep = self.url.indexOf('?') >= 0 ? '&' : '?';
+        var parts = [];
+        for (var k in query) {
+            parts.push(encodeURIComponent(k) + '=' + encodeURIComponent(query[k]));
+        }
+        return self.url + sep + parts.join('&');
+    };
+
+    /**
+     * Call route, cb receives the response or {code, error} if it failed.
+     */
+    KitSSE.prototype.request = function(route, msg, cb) {
+        var self = this;
+        self._post({route: route}, msg, cb);
+    };
+
+    KitSSE.prototype.notify = function(route, msg) {
+        var self = this;
+        self._post({route: route, notify: 1}, msg);
+    };
+
+    KitSSE.prototype._post = function(query, msg, cb) {
+        var self = this;
+        self._withToken(function(token, release) {
+            var headers = {'Content-Type': 'application/json'};
+            headers[TOKEN_HEADER] = token;
+            fetch(self._endpoint(query), {
+                method: 'POST',
+                headers: headers,
+                body: JSON.stringify(msg || {})
+            }).then(function(resp) {
+                // the token is consumed as soon as the session is found
+                release(resp.headers.get(TOKEN_HEADER));
+                return resp.text().then(function(text) {
+                    if (!resp.ok) {
+                        return {code: resp.status, error: text.trim()};
+                    }
+                    return text ? JSON.parse(text) : {};
+                });
+            }).then(function(body) {
+                cb && cb(body);
+            }, function(err) {
+                release();
+                cb && cb({code: 0, error: String(err)});
+            });
+        });
+    };
+
+    KitSSE.prototype.close = function() {
+        var self = this;
+        if (self.closed) {
+            return;
+        }
+        self.closed = true;
+        if (self._abort) {
+            self._abort.abort();
+            self._abort = null;
+        }
+    };
+
+    KitSSE.prototype._onEvent = function(event, data) {
+        var self = this;
+        switch (event) {
+            case 'handshake':
+                var hs = JSON.parse(data);
+                var release = self._releaseToken;
+                self._releaseToken = null;
+                if (hs.code && hs.code !== 200) {
+                    self.log && console.error('handshake rejected', hs);
+                    release && release();
+                    self.close();
+                    self._emit('error', hs);
+                    return;
+                }
+                release ? release(hs.token) : (self.token = hs.token);
+                if (self._reconnectAttempts > 0) {
+                    self._reconnectAttempts = 0;
+                } else {
+                    self._readyCb && self._readyCb();
+                }
+                break;
+            case 'message':
+                var msg = Message.decode(decodeBase64(data));
+                self._emit(msg.route, JSON.parse(Protocol.strdecode(msg.body)));
+                break;
+            case 'close':
+                self.log && console.log('session closed by server');
+                self.close();
+                self._emit('close');
+                break;
+        }
+    };
+
+    // events are parsed from a fetch stream rather than EventSource, which can
+    // not send headers. The token is held until the handshake event brings the
+    // next one.
+    KitSSE.prototype._subscribe = function() {
+        var self = this;
+        self._withToken(function(token, release) {
+            if (self.closed) {
+                release();
+                return;
+            }
+            self._releaseToken = release;
+            self._stream(token);
+        });
+    };
+
+    KitSSE.prototype._stream = function(token) {
+        var self = this;
+        var abort = self._abort = new AbortController();
+        var decoder = new TextDecoder();
+        var buffer = '';
+        var headers = {'Accept': 'text/event-stream'};
+        if (token) {
+            headers[TOKEN_HEADER] = token;
+        }
+
+        function dispatch(block) {
+            var event = 'message', data = [];
+            block.split('\n').forEach(function(line) {
+                if (line.indexOf('event: ') === 0) {
+                    event = line.slice(7);
+                } else if (line.indexOf('data: ') === 0) {
+                    data.push(line.slice(6));
+                }
+            });
+            if (data.length) {
+                self._onEvent(event, data.join('\n'));
+            }
+        }
+
+        fetch(self.url, {
+            headers: headers,
+            signal: abort.signal
+        }).then(function(resp) {
+            if (!resp.ok) {
+                throw new Error('subscribe status ' + resp.status);
+            }
+            var reader = resp.body.getReader();
+            function pump() {
+                return reader.read().then(function(r) {
+                    if (r.done) {
+                        return;
+                    }
+                    buffer += decoder.decode(r.value, {stream: true});
+                    var end;
+                    while ((end = buffer.indexOf('\n\n')) >= 0) {
+                        dispatch(buffer.slice(0, end));
+                        buffer = buffer.slice(end + 2);
+                    }
+                    return pump();
+                });
+            }
+            return pump();
+        }).then(function() {
+            self._reconnect(new Error('stream ended'));
+        }, function(err) {
+            self._reconnect(err);
+        });
+    };
+
+    KitSSE.prototype._reconnect = function(err) {
+        var self = this;
+        if (self._releaseToken) {
+            self._releaseToken();
+            self._releaseToken = null;
+        }
+        if (self.closed) {
+            return;
+        }
+        self.log && console.error(err);
+        if (self._reconnectAttempts >= self._reconnectMaxAttempts) {
+            self.log && console.log('reconnect failed after ' + self._reconnectAttempts + ' attempts');
+            self.close();
+            self._emit('close');
+            return;
+        }
+        self._reconnectAttempts++;
+        setTimeout(function() {
+            if (!self.closed) {
+                self._subscribe();
+            }
+        }, self._reconnectDelay * 1000);
+    };
+
+    if (Global) {
+        Global.KitSSE = KitSSE;
+    }
+
+    if (typeof module !== 'undefined') {
+        module.exports = KitSSE;
+    }
+})();
@@ -34,27 +34,44 @@ type wsConn struct {
 	conn   *websocket.Conn
 	typ    int // message type
 	reader io.Reader
+
+	// json text frame mode, see jsonFrame
+	jsonMode bool
+	pending  []byte         // packet bytes converted from the last frame
+	decoder  *PacketDecoder // splits written bytes into packets
+
+	// compress messages not shorter than it if permessage-deflate is negotiated,
+	// negative disables compression
+	compressThreshold int
 }
 
 // newWSConn return an initialized *wsConn
-func newWSConn(conn *websocket.Conn) (*wsConn, error) {
-	c := &wsConn{conn: conn}
-
-	t, r, err := conn.NextReader()
-	if err != nil {
-		return nil, err
+func newWSConn(conn *websocket.Conn, jsonMode bool) *wsConn {
+	c := &wsConn{conn: conn, jsonMode: jsonMode, compressThreshold: -1}
+	if jsonMode {
+		c.decoder = NewPacketDecoder()
 	}
-
-	c.typ = t
-	c.reader = r
-
-	return c, nil
+	return c
 }
 
 // Read reads data from the connection.
 // Read can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
 func (c *wsConn) Read(b []byte) (int, error) {
+	if c.jsonMode {
+		return c.readJSON(b)
+	}
+
+	// the first message is waited for in Read, so HandshakeTimeout covers it
+	if c.reader == nil {
+		t, r, err := c.conn.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		c.typ = t
+		c.reader = r
+	}
+
 	n, err := c.reader.Read(b)
 	if err != nil && err != io.EOF {
 		return n, err
@@ -73,6 +90,11 @@ func (c *wsConn) Read(b []byte) (int, error) {
 // Write can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
 func (c *wsConn) Write(b []byte) (int, error) {
+	if c.jsonMode {
+		return c.writeJSON(b)
+	}
+
+	c.setCompression(len(b))
 	err := c.conn.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
 		return 0, err
@@ -81,6 +103,51 @@ func (c *wsConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+func (c *wsConn) setCompression(size int) {
+	if c.compressThreshold >= 0 {
+		c.conn.EnableWriteCompression(size >= c.compressThreshold)
+	}
+}
+
+func (c *wsConn) readJSON(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		t, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if t != websocket.TextMessage {
+			continue
+		}
+
+		if c.pending, err = jsonFrameToPacket(data); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) writeJSON(b []byte) (int, error) {
+	packets, err := c.decoder.Decode(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range packets {
+		frame, err := packetToJSONFrame(p)
+		if err != nil {
+			return 0, err
+		}
+		c.setCompression(len(frame))
+		if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *wsConn) Close() error {
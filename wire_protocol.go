@@ -0,0 +1,83 @@
+package kit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the newest protocol version spoken by the server
+const ProtocolVersion = 1
+
+// Codecs of the wire
+const (
+	CodecBinary = "binary" // pomelo packets in binary frames
+	CodecJSON   = "json"   // jsonFrame in text frames, for debugging and simple clients
+)
+
+// WebSocket subprotocols, named kit.v<version>.<codec>
+const (
+	SubprotocolBinary = "kit.v1.binary"
+	SubprotocolJSON   = "kit.v1.json"
+)
+
+// WireProtocol is negotiated by websocket subprotocol
+type WireProtocol struct {
+	Version int
+	Codec   string
+}
+
+var defaultWireProtocol = WireProtocol{Version: ProtocolVersion, Codec: CodecBinary}
+
+func (p WireProtocol) String() string {
+	return fmt.Sprintf("kit.v%d.%s", p.Version, p.Codec)
+}
+
+// ParseSubprotocol parses kit.v<version>.<codec>
+func ParseSubprotocol(name string) (WireProtocol, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 3 || parts[0] != "kit" || !strings.HasPrefix(parts[1], "v") {
+		return WireProtocol{}, fmt.Errorf("kit:invalid subprotocol %s", name)
+	}
+
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil || version < 1 || version > ProtocolVersion {
+		return WireProtocol{}, fmt.Errorf("kit:unsupported subprotocol version %s", name)
+	}
+
+	codec := parts[2]
+	if codec != CodecBinary && codec != CodecJSON {
+		return WireProtocol{}, fmt.Errorf("kit:unsupported subprotocol codec %s", name)
+	}
+	return WireProtocol{Version: version, Codec: codec}, nil
+}
+
+// negotiateVersion returns the version both sides speak, client is the newest
+// version of the client and zero for clients before versioning
+func negotiateVersion(client, min, max int) (int, bool) {
+	if client == 0 {
+		client = 1
+	}
+	if client > max {
+		client = max
+	}
+	return client, client >= min
+}
+
+// negotiateCapabilities keeps the server order of capabilities the client also has.
+// Capabilities are offered by Server.Capabilities, kit itself only implements
+// CapabilityEncryption, others are up to the application, see KitConn.HasCapability.
+func negotiateCapabilities(server, client []string) []string {
+	has := make(map[string]bool, len(client))
+	for _, c := range client {
+		has[c] = true
+	}
+
+	result := []string{}
+	for _, c := range server {
+		if has[c] {
+			result = append(result, c)
+		}
+	}
+	return result
+}
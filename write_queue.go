@@ -0,0 +1,222 @@
+package kit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// SlowConsumerPolicy decides what KitConn.WriteMsg does when the write queue is full
+type SlowConsumerPolicy int
+
+const (
+	SlowConsumerError      SlowConsumerPolicy = iota // return ErrBufferExceed
+	SlowConsumerBlock                                // wait for space up to Server.WriteBlockTimeout
+	SlowConsumerDropOldest                           // drop the oldest queued message
+	SlowConsumerDropNewest                           // drop the message being written
+	SlowConsumerCoalesce                             // newer push replaces a queued one with the same route, or ErrBufferExceed
+	SlowConsumerDisconnect                           // close the connection
+)
+
+var ErrWriteBlockTimeout = errors.New("write queue blocked timeout")
+
+// Priority is the outbound lane of a message, higher lanes are written first
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	priorityCount
+)
+
+// outPacket is encoded by writeWorker right before writing
+type outPacket struct {
+	typ      PacketType
+	data     []byte
+	key      string // coalesce key, empty is never coalesced
+	route    string // route of a push, coalesced only when the lane is full
+	priority Priority
+}
+
+type writeQueue struct {
+	mutex   sync.Mutex
+	size    int
+	control []*outPacket // handshake, not limited by size
+	lanes   [priorityCount][]*outPacket
+	final   *outPacket    // close, written after high priority packets
+	ready   chan struct{} // signaled after push
+	space   chan struct{} // signaled after pop
+	done    chan struct{} // closed with the connection
+	closed  bool
+}
+
+func newWriteQueue(size int) *writeQueue {
+	return &writeQueue{
+		size:  size,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writeQueue) pushControl(p *outPacket) {
+	q.mutex.Lock()
+	q.control = append(q.control, p)
+	q.mutex.Unlock()
+	signal(q.ready)
+}
+
+// closeWith rejects further pushes like close. Normal packets are dropped so the
+// close does not wait for a slow client, p is popped after high priority ones,
+// e.g. a kick notice pushed right before closing.
+func (q *writeQueue) closeWith(p *outPacket) {
+	q.mutex.Lock()
+	if !q.closed {
+		q.final = p
+		q.lanes[PriorityNormal] = nil
+	}
+	q.mutex.Unlock()
+	signal(q.ready)
+	q.close()
+}
+
+// push appends p to the lane of its priority, every lane holds up to size packets
+func (q *writeQueue) push(p *outPacket, policy SlowConsumerPolicy, blockTimeout time.Duration) error {
+	if p.priority < 0 || p.priority >= priorityCount {
+		p.priority = PriorityNormal
+	}
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return ErrInvalidConnStatus
+		}
+
+		lane := q.lanes[p.priority]
+
+		if p.key != "" {
+			for i, item := range lane {
+				if item.key == p.key {
+					lane[i] = p
+					q.mutex.Unlock()
+					return nil
+				}
+			}
+		}
+
+		if len(lane) < q.size {
+			q.lanes[p.priority] = append(lane, p)
+			q.mutex.Unlock()
+			signal(q.ready)
+			return nil
+		}
+
+		switch policy {
+		case SlowConsumerCoalesce:
+			if p.route != "" {
+				for i, item := range lane {
+					if item.key == "" && item.route == p.route {
+						lane[i] = p
+						q.mutex.Unlock()
+						return nil
+					}
+				}
+			}
+			q.mutex.Unlock()
+			return ErrBufferExceed
+		case SlowConsumerDropOldest:
+			q.lanes[p.priority] = append(lane[1:], p)
+			q.mutex.Unlock()
+			signal(q.ready)
+			return nil
+		case SlowConsumerDropNewest:
+			q.mutex.Unlock()
+			return nil
+		case SlowConsumerBlock:
+			q.mutex.Unlock()
+		default:
+			q.mutex.Unlock()
+			return ErrBufferExceed
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(blockTimeout)
+		}
+
+		select {
+		case <-q.space:
+		case <-q.done:
+			return ErrInvalidConnStatus
+		case <-timer.C:
+			return ErrWriteBlockTimeout
+		}
+	}
+}
+
+// pop returns nil if the queue is empty
+func (q *writeQueue) pop() *outPacket {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.control) > 0 {
+		p := q.control[0]
+		q.control = q.control[1:]
+		return p
+	}
+
+	for i := priorityCount - 1; i >= 0; i-- {
+		lane := q.lanes[i]
+		if len(lane) > 0 {
+			p := lane[0]
+			lane[0] = nil
+			q.lanes[i] = lane[1:]
+			signal(q.space)
+			return p
+		}
+	}
+
+	if p := q.final; p != nil {
+		q.final = nil
+		return p
+	}
+	return nil
+}
+
+func (q *writeQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	n := len(q.control)
+	if q.final != nil {
+		n++
+	}
+	for _, lane := range q.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// close rejects further pushes, queued packets could still be popped
+func (q *writeQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
@@ -0,0 +1,58 @@
+package kit
+
+import (
+	"testing"
+)
+
+func popAll(q *writeQueue) []*outPacket {
+	var packets []*outPacket
+	for p := q.pop(); p != nil; p = q.pop() {
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+func TestCoalesceRoutesOnlyWhenFull(t *testing.T) {
+	q := newWriteQueue(3)
+	for _, data := range []string{"chat1", "chat2"} {
+		if err := q.push(&outPacket{data: []byte(data), route: "chat"}, SlowConsumerCoalesce, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := q.len(); n != 2 {
+		t.Fatalf("%d queued, pushes of a route were coalesced without backpressure", n)
+	}
+
+	q.push(&outPacket{data: []byte("other")}, SlowConsumerCoalesce, 0)
+	if err := q.push(&outPacket{data: []byte("chat3"), route: "chat"}, SlowConsumerCoalesce, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(&outPacket{data: []byte("tick"), route: "tick"}, SlowConsumerCoalesce, 0); err != ErrBufferExceed {
+		t.Fatalf("push without a queued route returned %v", err)
+	}
+
+	var got []string
+	for _, p := range popAll(q) {
+		got = append(got, string(p.data))
+	}
+	if len(got) != 3 || got[0] != "chat3" || got[1] != "chat2" || got[2] != "other" {
+		t.Fatalf("popped %v", got)
+	}
+}
+
+func TestCloseDropsNormalLane(t *testing.T) {
+	q := newWriteQueue(8)
+	for i := 0; i < 3; i++ {
+		q.push(&outPacket{typ: PacketData, data: []byte("normal")}, SlowConsumerError, 0)
+	}
+	q.push(&outPacket{typ: PacketData, data: []byte("notice"), priority: PriorityHigh}, SlowConsumerError, 0)
+	q.closeWith(&outPacket{typ: PacketClose})
+
+	packets := popAll(q)
+	if len(packets) != 2 || string(packets[0].data) != "notice" || packets[1].typ != PacketClose {
+		t.Fatalf("popped %d packets after close", len(packets))
+	}
+	if err := q.push(&outPacket{typ: PacketData}, SlowConsumerError, 0); err != ErrInvalidConnStatus {
+		t.Fatalf("push after close returned %v", err)
+	}
+}